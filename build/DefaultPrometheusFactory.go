@@ -12,6 +12,7 @@ import (
 // See: Factory
 // See: PrometheusCounters
 // See: PrometheusMetricsService
+// See: IPrometheusFormatter
 type DefaultPrometheusFactory struct {
 	*cbuild.Factory
 }
@@ -26,5 +27,8 @@ func NewDefaultPrometheusFactory() *DefaultPrometheusFactory {
 
 	c.RegisterType(prometheusCountersDescriptor, pcount.NewPrometheusCounters)
 	c.RegisterType(prometheusMetricsServiceDescriptor, pservices.NewPrometheusMetricsService)
+	c.RegisterType(cref.NewDescriptor("pip-services", "prometheus-formatter", "text", "*", "1.0"), pcount.NewPrometheusTextFormatter)
+	c.RegisterType(cref.NewDescriptor("pip-services", "prometheus-formatter", "openmetrics", "*", "1.0"), pcount.NewPrometheusOpenMetricsFormatter)
+	c.RegisterType(cref.NewDescriptor("pip-services", "prometheus-formatter", "protobuf", "*", "1.0"), pcount.NewPrometheusProtobufFormatter)
 	return &c
 }
@@ -0,0 +1,46 @@
+package count
+
+import (
+	"io"
+)
+
+// IPrometheusFormatter is an interface for components that write Prometheus metric families
+// in an exposition format. PrometheusCounters and PrometheusMetricsService find formatters
+// by *:prometheus-formatter:*:*:1.0 descriptor, so the built-in formats can be replaced
+// or extended without changes of the components.
+type IPrometheusFormatter interface {
+	// Format gets a name of the exposition format, i.e. text, openmetrics or protobuf.
+	// A formatter replaces another formatter with the same name.
+	Format() string
+
+	// ContentType gets HTTP content type of the output.
+	ContentType() string
+
+	// Accepts checks if the formatter can produce output for a media range from HTTP Accept header.
+	//	Parameters:
+	//		- mediaType  a lowercase media type, i.e. text/plain.
+	//		- params     media type parameters except quality factor, i.e. version.
+	// Returns true if the output satisfies the media range.
+	Accepts(mediaType string, params map[string]string) bool
+
+	// Write writes metric families.
+	//	Parameters:
+	//		- writer    a writer to write output to.
+	//		- families  metric families sorted by name.
+	// Returns error or nil, if no errors occured.
+	Write(writer io.Writer, families []*PrometheusMetricFamily) error
+}
+
+// IPrometheusSnapshotFormatter is an optional interface of formatters that write counters
+// as they are kept by components, before they are converted into metric families.
+// PrometheusMetricsService uses it instead of Write when the formatter implements it.
+type IPrometheusSnapshotFormatter interface {
+	IPrometheusFormatter
+
+	// WriteSnapshots writes counter snapshots.
+	//	Parameters:
+	//		- writer     a writer to write output to.
+	//		- snapshots  counter snapshots to write.
+	// Returns error or nil, if no errors occured.
+	WriteSnapshots(writer io.Writer, snapshots []*PrometheusCounterSnapshot) error
+}
@@ -1,17 +1,406 @@
 package count
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	cconv "github.com/pip-services3-gox/pip-services3-commons-gox/convert"
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cref "github.com/pip-services3-gox/pip-services3-commons-gox/refer"
 	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+	clog "github.com/pip-services3-gox/pip-services3-components-gox/log"
 )
 
-//  PrometheusCounterConverter is helper class that converts performance counter values into
-//  a response from Prometheus metrics service.
+// PrometheusCounterConverter is helper class that converts performance counter values into
+// a response from Prometheus metrics service.
 var PrometheusCounterConverter TPrometheusCounterConverter = TPrometheusCounterConverter{}
 
 type TPrometheusCounterConverter struct {
+	logger     *clog.CompositeLogger
+	lock       sync.Mutex
+	reported   map[string]bool
+	rules      []*PrometheusMappingRule
+	native     bool
+	age        bool
+	cumulative bool
+	formatters []IPrometheusFormatter
+	labels     []PrometheusLabel
+	namespace  string
+	subsystem  string
+	metadata   *PrometheusMetadataRegistry
+}
+
+// DefaultPrometheusMappingRules are rules applied after configured ones.
+// They turn <service>.<command>.exec_time counters into exec_time metric with service and command labels.
+var DefaultPrometheusMappingRules = []*PrometheusMappingRule{
+	mustPrometheusMappingRule("*.*.exec_time", "exec_time", "service", "command"),
+}
+
+func mustPrometheusMappingRule(pattern string, name string, labels ...string) *PrometheusMappingRule {
+	rule, err := NewPrometheusMappingRule(pattern, name, labels...)
+	if err != nil {
+		panic(err)
+	}
+	return rule
+}
+
+// NewPrometheusCounterConverter creates a new instance of the converter.
+// Unlike the shared PrometheusCounterConverter it can report name collisions
+// through loggers set by SetReferences.
+// Returns *TPrometheusCounterConverter
+// pointer on new instance
+func NewPrometheusCounterConverter() *TPrometheusCounterConverter {
+	return &TPrometheusCounterConverter{
+		logger:   clog.NewCompositeLogger(),
+		reported: make(map[string]bool),
+	}
+}
+
+// SetReferences method are sets references to dependent components.
+// Referenced *:prometheus-formatter:*:*:1.0 components replace or add exposition formats.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- references  cref.IReferences
+// references to locate the component dependencies.
+func (c *TPrometheusCounterConverter) SetReferences(ctx context.Context, references cref.IReferences) {
+	if c.logger == nil {
+		c.logger = clog.NewCompositeLogger()
+	}
+	c.logger.SetReferences(ctx, references)
+
+	for _, ref := range references.GetOptional(cref.NewDescriptor("*", "prometheus-formatter", "*", "*", "1.0")) {
+		if formatter, ok := ref.(IPrometheusFormatter); ok {
+			c.SetFormatter(formatter)
+		}
+	}
+}
+
+// Configure method are configures component by passing configuration parameters.
+// Mapping rules and constant labels set in the configuration replace previously set ones.
+//	Configuration parameters:
+//		- mapping:
+//			- rules:
+//				- <index>:
+//					- pattern:  a template where * matches one name segment and ** matches one or more segments
+//					- regex:    a regular expression used instead of the template
+//					- name:     a metric name that may reference matched values as $1, $2...
+//					- labels:   comma-separated label names for the matched values
+//		- options:
+//			- native_counters:  expose Increment counters as cumulative Prometheus counters with _total suffix (default: false)
+//			- timestamp_age:    expose age of Timestamp counters as <name>_age_seconds gauges (default: false)
+//			- temporality:      cumulative or delta, see SetTemporality (default: delta)
+//			- namespace:        (optional) a prefix of all metric names, i.e. acme
+//			- subsystem:        (optional) a prefix of all metric names after the namespace, i.e. billing
+//		- labels:
+//			- <name>:           a constant label added to all series, i.e. labels.env=prod
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- config   *cconf.ConfigParams
+// configuration parameters to be set.
+func (c *TPrometheusCounterConverter) Configure(ctx context.Context, config *cconf.ConfigParams) {
+	c.SetNativeCounters(config.GetAsBooleanWithDefault("options.native_counters", c.NativeCounters()))
+	c.SetTimestampAge(config.GetAsBooleanWithDefault("options.timestamp_age", c.TimestampAge()))
+	c.SetTemporality(config.GetAsStringWithDefault("options.temporality", c.Temporality()))
+	c.SetNamespace(
+		config.GetAsStringWithDefault("options.namespace", c.Namespace()),
+		config.GetAsStringWithDefault("options.subsystem", c.Subsystem()),
+	)
+
+	labels := config.GetSection("labels")
+	if labels.Len() > 0 {
+		constLabels := make(map[string]string)
+		for _, name := range labels.Keys() {
+			constLabels[name] = labels.GetAsString(name)
+		}
+		c.SetConstLabels(constLabels)
+	}
+
+	if err := c.Metadata().Configure(ctx, config); err != nil && c.logger != nil {
+		c.logger.Error(ctx, "PrometheusCounterConverter", err, "Invalid metadata of counters")
+	}
+
+	section := config.GetSection("mapping.rules")
+	names := sortConfigSectionNames(section.GetSectionNames())
+	if len(names) == 0 {
+		return
+	}
+
+	rules := make([]*PrometheusMappingRule, 0, len(names)+len(DefaultPrometheusMappingRules))
+	for _, name := range names {
+		ruleConfig := section.GetSection(name)
+		labels := make([]string, 0)
+		for _, label := range strings.Split(ruleConfig.GetAsString("labels"), ",") {
+			labels = append(labels, strings.TrimSpace(label))
+		}
+		if len(labels) == 1 && labels[0] == "" {
+			labels = labels[:0]
+		}
+
+		var rule *PrometheusMappingRule
+		var err error
+		if regex := ruleConfig.GetAsString("regex"); regex != "" {
+			rule, err = NewPrometheusRegexMappingRule(regex, ruleConfig.GetAsString("name"), labels...)
+		} else {
+			rule, err = NewPrometheusMappingRule(ruleConfig.GetAsString("pattern"), ruleConfig.GetAsString("name"), labels...)
+		}
+		if err != nil {
+			if c.logger != nil {
+				c.logger.Error(ctx, "PrometheusCounterConverter", err, "Invalid mapping rule %s", name)
+			}
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	c.SetMappingRules(append(rules, DefaultPrometheusMappingRules...))
+}
+
+// NativeCounters checks if Increment counters are exposed as Prometheus counters.
+// Otherwise they are exposed as gauges for backward compatibility.
+// Native counters will be enabled by default in the next major version.
+// Returns bool
+func (c *TPrometheusCounterConverter) NativeCounters() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.native
+}
+
+// SetNativeCounters turns on or off exposition of Increment counters as Prometheus counters.
+//	Parameters:
+//		- native  true to expose Increment counters as counters with _total suffix.
+func (c *TPrometheusCounterConverter) SetNativeCounters(native bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.native = native
+}
+
+// Temporality gets how values of counters are exposed.
+// Returns string
+// PrometheusCumulativeTemporality or PrometheusDeltaTemporality
+func (c *TPrometheusCounterConverter) Temporality() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cumulative {
+		return PrometheusCumulativeTemporality
+	}
+	return PrometheusDeltaTemporality
+}
+
+// SetTemporality sets how values of counters are exposed.
+// In delta temporality values are exposed as they are kept by CachedCounters, they are reset
+// after reset timeout and min, max and average describe the period since the last reset.
+// In cumulative temporality Increment counters are exposed as Prometheus counters with totals
+// and _created timestamps, and Interval and Statistics counters without histograms or summaries
+// are exposed as summaries with cumulative _count, _sum and _created and <name>_max and <name>_min gauges
+// of all values observed since the counter was created.
+//	Parameters:
+//		- temporality  PrometheusCumulativeTemporality or PrometheusDeltaTemporality, other values mean delta.
+func (c *TPrometheusCounterConverter) SetTemporality(temporality string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cumulative = temporality == PrometheusCumulativeTemporality
+}
+
+// TimestampAge checks if the age of Timestamp counters is exposed
+// as <name>_age_seconds gauge next to the timestamp itself.
+// Returns bool
+// true if the age is exposed
+func (c *TPrometheusCounterConverter) TimestampAge() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.age
+}
+
+// SetTimestampAge turns on or off exposition of the age of Timestamp counters.
+//	Parameters:
+//		- age  true to expose the age of Timestamp counters in seconds.
+func (c *TPrometheusCounterConverter) SetTimestampAge(age bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.age = age
+}
+
+// ConstLabels gets labels added to all exposed series.
+// Returns []PrometheusLabel
+// constant labels sorted by names
+func (c *TPrometheusCounterConverter) ConstLabels() []PrometheusLabel {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make([]PrometheusLabel, len(c.labels))
+	copy(result, c.labels)
+	return result
+}
+
+// SetConstLabels sets labels added to all exposed series, i.e. env or region.
+// Label names are sanitized, labels of counters and source and instance labels
+// take precedence over constant labels with the same names.
+//	Parameters:
+//		- labels  a map of label names and values.
+func (c *TPrometheusCounterConverter) SetConstLabels(labels map[string]string) {
+	constLabels := make([]PrometheusLabel, 0, len(labels))
+	for name, value := range labels {
+		name = PrometheusNameSanitizer.SanitizeLabelName(name)
+		if name != "" && !hasPrometheusLabel(constLabels, name) {
+			constLabels = append(constLabels, PrometheusLabel{Name: name, Value: value})
+		}
+	}
+	sortPrometheusLabels(constLabels)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.labels = constLabels
+}
+
+// Namespace gets a prefix of all metric names.
+// Returns string
+// a namespace or empty string
+func (c *TPrometheusCounterConverter) Namespace() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.namespace
+}
+
+// Subsystem gets a prefix of all metric names that goes after the namespace.
+// Returns string
+// a subsystem or empty string
+func (c *TPrometheusCounterConverter) Subsystem() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.subsystem
+}
+
+// SetNamespace sets prefixes of all metric names. Metric names become <namespace>_<subsystem>_<name>,
+// empty prefixes are skipped.
+//	Parameters:
+//		- namespace  a namespace, i.e. acme.
+//		- subsystem  a subsystem, i.e. billing.
+func (c *TPrometheusCounterConverter) SetNamespace(namespace string, subsystem string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.namespace = PrometheusNameSanitizer.SanitizeMetricName(namespace)
+	c.subsystem = PrometheusNameSanitizer.SanitizeMetricName(subsystem)
+}
+
+// Metadata gets a registry of HELP text, units and explicit types of counters.
+// Returns *PrometheusMetadataRegistry
+// the registry of metadata
+func (c *TPrometheusCounterConverter) Metadata() *PrometheusMetadataRegistry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.metadata == nil {
+		c.metadata = NewPrometheusMetadataRegistry()
+	}
+	return c.metadata
+}
+
+// SetMetadata sets a registry of HELP text, units and explicit types of counters.
+//	Parameters:
+//		- metadata  a registry of metadata.
+func (c *TPrometheusCounterConverter) SetMetadata(metadata *PrometheusMetadataRegistry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.metadata = metadata
+}
+
+// Formatters gets formatters of exposition formats supported by the converter.
+// Returns []IPrometheusFormatter
+// registered formatters, the first one is the default
+func (c *TPrometheusCounterConverter) Formatters() []IPrometheusFormatter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.formatters == nil {
+		c.formatters = DefaultPrometheusFormatters()
+	}
+	result := make([]IPrometheusFormatter, len(c.formatters))
+	copy(result, c.formatters)
+	return result
+}
+
+// SetFormatter registers a formatter of an exposition format.
+// It replaces a formatter of the format with the same name or adds a new format.
+//	Parameters:
+//		- formatter  a formatter to register.
+func (c *TPrometheusCounterConverter) SetFormatter(formatter IPrometheusFormatter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.formatters == nil {
+		c.formatters = DefaultPrometheusFormatters()
+	}
+	for index, existing := range c.formatters {
+		if existing.Format() == formatter.Format() {
+			c.formatters[index] = formatter
+			return
+		}
+	}
+	c.formatters = append(c.formatters, formatter)
+}
+
+// Formatter gets a formatter of the specified exposition format.
+//	Parameters:
+//		- format  an exposition format name.
+// Returns IPrometheusFormatter
+// the formatter of the format or the default (text) formatter when the format is unknown
+func (c *TPrometheusCounterConverter) Formatter(format string) IPrometheusFormatter {
+	formatters := c.Formatters()
+	for _, formatter := range formatters {
+		if formatter.Format() == format {
+			return formatter
+		}
+	}
+	return formatters[0]
+}
+
+// NegotiateFormatter selects a formatter based on the value of HTTP Accept header.
+//	Parameters:
+//		- accept  a value of Accept header sent by a scraper.
+// Returns IPrometheusFormatter
+// the selected formatter
+func (c *TPrometheusCounterConverter) NegotiateFormatter(accept string) IPrometheusFormatter {
+	return NegotiatePrometheusFormatter(accept, c.Formatters())
+}
+
+// MappingRules gets rules that split counter names into metric names and labels.
+// Returns []*PrometheusMappingRule
+// configured rules or DefaultPrometheusMappingRules when rules were not set
+func (c *TPrometheusCounterConverter) MappingRules() []*PrometheusMappingRule {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.rules == nil {
+		return DefaultPrometheusMappingRules
+	}
+	return c.rules
+}
+
+// SetMappingRules sets rules that split counter names into metric names and labels.
+// Rules are checked in order and the first matching rule wins.
+//	Parameters:
+//		- rules  mapping rules to set.
+func (c *TPrometheusCounterConverter) SetMappingRules(rules []*PrometheusMappingRule) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rules = rules
 }
 
 // ToString method converts the given counters to a string that is returned by Prometheus metrics service.
@@ -22,148 +411,388 @@ type TPrometheusCounterConverter struct {
 // Returns string
 // string view of counter
 func (c *TPrometheusCounterConverter) ToString(counters []ccount.Counter, source string, instance string) string {
-
 	if len(counters) == 0 {
 		return ""
 	}
 
-	var builder string = ""
-
-	for _, counter := range counters {
-		counterName := c.parseCounterName(counter)
-		labels := c.generateCounterLabel(counter, source, instance)
-
-		switch counter.Type {
-		case ccount.Increment:
-			builder += "# TYPE " + counterName + " gauge\n"
-			builder += counterName + labels + " " + cconv.StringConverter.ToString(counter.Count) + "\n"
-		case ccount.Interval:
-			builder += "# TYPE " + counterName + "_max gauge\n"
-			builder += counterName + "_max" + labels + " " + cconv.StringConverter.ToString(counter.Max) + "\n"
-			builder += "# TYPE " + counterName + "_min gauge\n"
-			builder += counterName + "_min" + labels + " " + cconv.StringConverter.ToString(counter.Min) + "\n"
-			builder += "# TYPE " + counterName + "_average gauge\n"
-			builder += counterName + "_average" + labels + " " + cconv.StringConverter.ToString(counter.Average) + "\n"
-			builder += "# TYPE " + counterName + "_count gauge\n"
-			builder += counterName + "_count" + labels + " " + cconv.StringConverter.ToString(counter.Count) + "\n"
-		case ccount.LastValue:
-			builder += "# TYPE " + counterName + " gauge\n"
-			builder += counterName + labels + " " + cconv.StringConverter.ToString(counter.Last) + "\n"
-		case ccount.Statistics:
-			builder += "# TYPE " + counterName + "_max gauge\n"
-			builder += counterName + "_max" + labels + " " + cconv.StringConverter.ToString(counter.Max) + "\n"
-			builder += "# TYPE " + counterName + "_min gauge\n"
-			builder += counterName + "_min" + labels + " " + cconv.StringConverter.ToString(counter.Min) + "\n"
-			builder += "# TYPE " + counterName + "_average gauge\n"
-			builder += counterName + "_average" + labels + " " + cconv.StringConverter.ToString(counter.Average) + "\n"
-			builder += "# TYPE " + counterName + "_count gauge\n"
-			builder += counterName + "_count" + labels + " " + cconv.StringConverter.ToString(counter.Count) + "\n"
-		case ccount.Timestamp: // Prometheus doesn't support non-numeric metrics
-			builder += "# TYPE " + counterName + " gauge\n" //" untyped\n"
-			builder += counterName + labels + " " + cconv.StringConverter.ToString(counter.Time.Unix()) + "\n"
-		}
-	}
-
-	return builder
+	return string(c.FormatFamilies(PrometheusTextFormat, c.ToFamilies(counters, source, instance)))
 }
 
-func (c *TPrometheusCounterConverter) AtomicCountersToCounters(atomicCounters []*ccount.AtomicCounter) []ccount.Counter {
-	counters := make([]ccount.Counter, len(atomicCounters))
+// ToOpenMetricsString method converts the given counters to a string in OpenMetrics 1.0 format.
+// The result is always terminated by # EOF line, even when there are no counters.
+//	Parameters:
+//		- counters  a list of counters to convert.
+//		- source    a source (context) name.
+//		- instance  a unique instance name (usually a host name).
+// Returns string
+// OpenMetrics view of counters
+func (c *TPrometheusCounterConverter) ToOpenMetricsString(counters []ccount.Counter, source string, instance string) string {
+	return string(c.FormatFamilies(PrometheusOpenMetricsFormat, c.ToFamilies(counters, source, instance)))
+}
 
-	for _, atomicCounter := range atomicCounters {
-		counter := ccount.Counter{
-			Name:    atomicCounter.Name(),
-			Type:    atomicCounter.Type(),
-			Last:    atomicCounter.Last(),
-			Count:   atomicCounter.Count(),
-			Min:     atomicCounter.Min(),
-			Max:     atomicCounter.Max(),
-			Average: atomicCounter.Average(),
-			Time:    atomicCounter.Time(),
-		}
+// ToProtobuf method converts the given counters to length-delimited io.prometheus.client.MetricFamily messages.
+//	Parameters:
+//		- counters  a list of counters to convert.
+//		- source    a source (context) name.
+//		- instance  a unique instance name (usually a host name).
+// Returns []byte
+// protobuf view of counters
+func (c *TPrometheusCounterConverter) ToProtobuf(counters []ccount.Counter, source string, instance string) []byte {
+	return c.FormatFamilies(PrometheusProtobufFormat, c.ToFamilies(counters, source, instance))
+}
 
-		counters = append(counters, counter)
-	}
+// ToFormat method converts the given counters to the specified exposition format.
+//	Parameters:
+//		- format    an exposition format: PrometheusTextFormat, PrometheusOpenMetricsFormat or PrometheusProtobufFormat.
+//		- counters  a list of counters to convert.
+//		- source    a source (context) name.
+//		- instance  a unique instance name (usually a host name).
+// Returns []byte
+// view of counters in the requested format
+func (c *TPrometheusCounterConverter) ToFormat(format string, counters []ccount.Counter, source string, instance string) []byte {
+	return c.FormatFamilies(format, c.ToFamilies(counters, source, instance))
+}
 
-	return counters
+// WriteTo method streams the given counters to the writer in the text format
+// that is returned by Prometheus metrics service.
+//	Parameters:
+//		- writer    a writer to write output to, i.e. http.ResponseWriter.
+//		- counters  a list of counters to convert.
+//		- source    a source (context) name.
+//		- instance  a unique instance name (usually a host name).
+// Returns error or nil, if no errors occured.
+func (c *TPrometheusCounterConverter) WriteTo(writer io.Writer, counters []ccount.Counter, source string, instance string) error {
+	return c.WriteFormatTo(writer, PrometheusTextFormat, counters, source, instance)
+}
+
+// WriteFormatTo method streams the given counters to the writer in the specified exposition format.
+//	Parameters:
+//		- writer    a writer to write output to, i.e. http.ResponseWriter.
+//		- format    an exposition format: PrometheusTextFormat, PrometheusOpenMetricsFormat, PrometheusProtobufFormat
+//		            or a format of a registered formatter.
+//		- counters  a list of counters to convert.
+//		- source    a source (context) name.
+//		- instance  a unique instance name (usually a host name).
+// Returns error or nil, if no errors occured.
+func (c *TPrometheusCounterConverter) WriteFormatTo(writer io.Writer, format string, counters []ccount.Counter, source string, instance string) error {
+	return c.Formatter(format).Write(writer, c.ToFamilies(counters, source, instance))
+}
 
+// FormatFamilies method writes metric families in the specified exposition format.
+//	Parameters:
+//		- format    an exposition format: PrometheusTextFormat, PrometheusOpenMetricsFormat, PrometheusProtobufFormat
+//		            or a format of a registered formatter.
+//		- families  metric families to write.
+// Returns []byte
+// view of families in the requested format
+func (c *TPrometheusCounterConverter) FormatFamilies(format string, families []*PrometheusMetricFamily) []byte {
+	buffer := bytes.Buffer{}
+	// Writes into memory buffer don't fail
+	_ = c.Formatter(format).Write(&buffer, families)
+	return buffer.Bytes()
 }
 
-func (c *TPrometheusCounterConverter) generateCounterLabel(counter ccount.Counter, source string, instance string) string {
+// ToFamilies method converts the given counters into Prometheus metric families.
+// Samples that share the same name are grouped into a single family. Families are sorted by name,
+// series inside a family are sorted by labels and labels are sorted by name, so the result is stable.
+// When samples of a counter collide with samples of another counter (the same family with different type
+// or the same series) the counter that comes later in alphabetical order is dropped.
+//	Parameters:
+//		- counters  a list of counters to convert.
+//		- source    a source (context) name.
+//		- instance  a unique instance name (usually a host name).
+// Returns []*PrometheusMetricFamily
+// metric families sorted by name
+func (c *TPrometheusCounterConverter) ToFamilies(counters []ccount.Counter, source string, instance string) []*PrometheusMetricFamily {
+	return c.SnapshotsToFamilies(NewPrometheusCounterSnapshots(counters), source, instance)
+}
 
-	labels := make(map[string]string, 0)
+// SnapshotsToFamilies method converts the given counter snapshots into Prometheus metric families.
+// It works the same way as ToFamilies but also uses the state kept by PrometheusCounters.
+//
+//	Parameters:
+//		- snapshots  a list of counter snapshots to convert.
+//		- source     a source (context) name.
+//		- instance   a unique instance name (usually a host name).
+//
+// Returns []*PrometheusMetricFamily
+// metric families sorted by name
+func (c *TPrometheusCounterConverter) SnapshotsToFamilies(snapshots []*PrometheusCounterSnapshot, source string, instance string) []*PrometheusMetricFamily {
+	builder, collisions := c.buildFamilies(snapshots, source, instance)
+	c.reportCollisions(collisions)
+	return builder.build()
+}
 
-	if source != "" {
-		labels["source"] = source
+// Logs collisions that haven't been reported before, so they don't flood the log on every scrape
+func (c *TPrometheusCounterConverter) reportCollisions(collisions []prometheusCollision) {
+	if c.logger == nil || len(collisions) == 0 {
+		return
 	}
 
-	if instance != "" {
-		labels["instance"] = instance
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.reported == nil {
+		c.reported = make(map[string]bool)
+	}
+	for _, collision := range collisions {
+		key := collision.counter + "\xff" + collision.other
+		if c.reported[key] {
+			continue
+		}
+		c.reported[key] = true
+		c.logger.Warn(context.Background(), "PrometheusCounterConverter",
+			"Counter %s was dropped because it collides with counter %s in metric family %s",
+			collision.counter, collision.other, collision.family)
 	}
+}
 
-	nameParts := strings.Split(counter.Name, ".")
+func (c *TPrometheusCounterConverter) buildFamilies(snapshots []*PrometheusCounterSnapshot, source string, instance string) (*prometheusFamilyBuilder, []prometheusCollision) {
+	sorted := make([]*PrometheusCounterSnapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	registry := c.Metadata()
+	builder := newPrometheusFamilyBuilder()
+	for _, counter := range sorted {
+		counterName, labels := c.mapSnapshot(counter, source, instance)
+		if counterName == "" {
+			continue
+		}
+		metadata, _ := registry.Find(counter.Name)
+		samples := c.counterSamples(counter, counterName, labels, metadata.Type)
+		for index := range samples {
+			samples[index].help = metadata.Help
+			samples[index].unit = metadata.Unit
+		}
+		builder.add(counter.Name, samples...)
+	}
 
-	// If there are other predictable names from which we can parse labels, we can add them below
-	if len(nameParts) >= 3 && nameParts[2] == "exec_time" {
-		labels["service"] = nameParts[0]
-		labels["command"] = nameParts[1]
+	return builder, builder.collisions
+}
+
+// Maps the snapshot into a metric name and labels including labels of labeled series.
+// Snapshots folded by the series limiter already have the metric name and labels.
+func (c *TPrometheusCounterConverter) mapSnapshot(counter *PrometheusCounterSnapshot, source string, instance string) (string, []PrometheusLabel) {
+	if counter.folded {
+		_, labels := c.mapCounter(ccount.Counter{}, source, instance)
+		for _, label := range counter.Labels {
+			if !hasPrometheusLabel(labels, label.Name) {
+				labels = append(labels, label)
+			}
+		}
+		return counter.Name, c.withConstLabels(labels)
 	}
 
-	if len(labels) == 0 {
-		return ""
+	counterName, labels := c.mapCounter(counter.Counter, source, instance)
+	for _, label := range counter.Labels {
+		name := PrometheusNameSanitizer.SanitizeLabelName(label.Name)
+		if name != "" && !hasPrometheusLabel(labels, name) {
+			labels = append(labels, PrometheusLabel{Name: name, Value: label.Value})
+		}
 	}
+	return counterName, c.withConstLabels(labels)
+}
 
-	builder := "{"
-	for key := range labels {
-		if len(builder) > 1 {
-			builder += ","
+// Adds constant labels that are not set yet
+func (c *TPrometheusCounterConverter) withConstLabels(labels []PrometheusLabel) []PrometheusLabel {
+	for _, label := range c.ConstLabels() {
+		if !hasPrometheusLabel(labels, label.Name) {
+			labels = append(labels, label)
 		}
-		builder += key + `="` + labels[key] + `"`
 	}
-	builder += "}"
+	return labels
+}
 
-	return builder
+// Adds namespace and subsystem prefixes to a metric name
+func (c *TPrometheusCounterConverter) withNamespace(name string) string {
+	c.lock.Lock()
+	namespace, subsystem := c.namespace, c.subsystem
+	c.lock.Unlock()
+
+	if subsystem != "" {
+		name = subsystem + "_" + name
+	}
+	if namespace != "" {
+		name = namespace + "_" + name
+	}
+	return name
 }
 
-func (c *TPrometheusCounterConverter) parseCounterName(counter ccount.Counter) string {
-	if counter.Name == "" {
-		return ""
+// Produces samples of the counter. An explicit type from metadata overrides the type
+// of Increment, LastValue and Timestamp counters exposed as a single value.
+func (c *TPrometheusCounterConverter) counterSamples(counter *PrometheusCounterSnapshot, counterName string,
+	labels []PrometheusLabel, typ PrometheusMetricType) []prometheusSample {
+	gauge := func(name string, value float64) prometheusSample {
+		return prometheusSample{
+			family: name,
+			typ:    PrometheusTypeGauge,
+			metric: &PrometheusMetric{Labels: labels, Value: value},
+		}
+	}
+	// Exposes a single value with an explicit type
+	typed := func(value float64) []prometheusSample {
+		switch typ {
+		case PrometheusTypeCounter:
+			return []prometheusSample{{
+				family: strings.TrimSuffix(counterName, "_total"),
+				typ:    PrometheusTypeCounter,
+				metric: &PrometheusMetric{Labels: labels, Value: value, Created: counter.Created, Exemplar: counter.Exemplar},
+			}}
+		case PrometheusTypeUntyped:
+			return []prometheusSample{{
+				family: counterName,
+				typ:    PrometheusTypeUntyped,
+				metric: &PrometheusMetric{Labels: labels, Value: value},
+			}}
+		}
+		return []prometheusSample{gauge(counterName, value)}
 	}
 
-	nameParts := strings.Split(counter.Name, ".")
+	cumulative := c.Temporality() == PrometheusCumulativeTemporality
 
-	// If there are other predictable names from which we can parse labels, we can add them below
-	if len(nameParts) >= 3 && nameParts[2] == "exec_time" {
-		return nameParts[2]
+	switch counter.Type {
+	case ccount.Increment:
+		if typ != "" {
+			if c.NativeCounters() || cumulative || typ == PrometheusTypeCounter {
+				return typed(float64(counter.Total))
+			}
+			return typed(float64(counter.Count))
+		}
+		if c.NativeCounters() || cumulative {
+			return []prometheusSample{{
+				family: strings.TrimSuffix(counterName, "_total"),
+				typ:    PrometheusTypeCounter,
+				metric: &PrometheusMetric{Labels: labels, Value: float64(counter.Total), Created: counter.Created, Exemplar: counter.Exemplar},
+			}}
+		}
+		return []prometheusSample{gauge(counterName, float64(counter.Count))}
+	case ccount.Interval, ccount.Statistics:
+		if counter.Histogram != nil || counter.NativeHistogram != nil {
+			metric := &PrometheusMetric{Labels: labels, NativeHistogram: counter.NativeHistogram}
+			if histogram := counter.Histogram; histogram != nil {
+				metric.Count = histogram.Count
+				metric.Sum = histogram.Sum
+				metric.Buckets = histogram.Buckets
+				metric.Created = histogram.Created
+				metric.Exemplar = histogram.Exemplar
+			} else {
+				metric.Count = counter.NativeHistogram.Count
+				metric.Sum = counter.NativeHistogram.Sum
+				metric.Created = counter.NativeHistogram.Created
+			}
+			return []prometheusSample{{family: counterName, typ: PrometheusTypeHistogram, metric: metric}}
+		}
+		if summary := counter.Summary; summary != nil {
+			return []prometheusSample{{
+				family: counterName,
+				typ:    PrometheusTypeSummary,
+				metric: &PrometheusMetric{
+					Labels:    labels,
+					Count:     summary.Count,
+					Sum:       summary.Sum,
+					Quantiles: summary.Quantiles,
+					Created:   summary.Created,
+				},
+			}}
+		}
+		if cumulative {
+			return []prometheusSample{
+				{
+					family: counterName,
+					typ:    PrometheusTypeSummary,
+					metric: &PrometheusMetric{
+						Labels:  labels,
+						Count:   uint64(counter.Count),
+						Sum:     counter.Sum,
+						Created: counter.Created,
+					},
+				},
+				gauge(counterName+"_max", counter.Max),
+				gauge(counterName+"_min", counter.Min),
+			}
+		}
+		return []prometheusSample{
+			gauge(counterName+"_max", counter.Max),
+			gauge(counterName+"_min", counter.Min),
+			gauge(counterName+"_average", counter.Average),
+			gauge(counterName+"_count", float64(counter.Count)),
+		}
+	case ccount.LastValue:
+		return typed(counter.Last)
+	case ccount.Timestamp: // Prometheus doesn't support non-numeric metrics
+		samples := typed(float64(counter.Time.Unix()))
+		if c.TimestampAge() && !counter.Time.IsZero() {
+			samples = append(samples, gauge(counterName+"_age_seconds", time.Since(counter.Time).Seconds()))
+		}
+		return samples
 	}
+	return []prometheusSample{}
+}
 
-	// TODO: are there other assumptions we can make?
-	// Or just return as a single, valid name
-	result := strings.ToLower(counter.Name)
-	result = strings.Replace(result, ".", "_", -1)
-	result = strings.Replace(result, "/", "_", -1)
+func (c *TPrometheusCounterConverter) AtomicCountersToCounters(atomicCounters []*ccount.AtomicCounter) []ccount.Counter {
+	counters := make([]ccount.Counter, 0, len(atomicCounters))
 
-	return result
+	for _, atomicCounter := range atomicCounters {
+		counters = append(counters, atomicCounter.GetCounter())
+	}
+
+	return counters
 }
 
-func (c *TPrometheusCounterConverter) parseCounterLabels(counter ccount.Counter, source string, instance string) interface{} {
-	labels := make(map[string]string, 0)
+// Maps the counter name into a metric name and labels using the first matching rule
+func (c *TPrometheusCounterConverter) mapCounter(counter ccount.Counter, source string, instance string) (string, []PrometheusLabel) {
+	labels := make([]PrometheusLabel, 0)
 
 	if source != "" {
-		labels["source"] = source
+		labels = append(labels, PrometheusLabel{Name: "source", Value: source})
 	}
 
 	if instance != "" {
-		labels["instance"] = instance
+		labels = append(labels, PrometheusLabel{Name: "instance", Value: instance})
 	}
 
-	nameParts := strings.Split(counter.Name, ".")
+	if counter.Name == "" {
+		return "", labels
+	}
 
-	// If there are other predictable names from which we can parse labels, we can add them below
-	if len(nameParts) >= 3 && nameParts[2] == "exec_time" {
-		labels["service"] = nameParts[0]
-		labels["command"] = nameParts[1]
+	for _, rule := range c.MappingRules() {
+		name, ruleLabels, ok := rule.Match(counter.Name)
+		if !ok {
+			continue
+		}
+		for _, label := range ruleLabels {
+			if !hasPrometheusLabel(labels, label.Name) {
+				labels = append(labels, label)
+			}
+		}
+		return c.withNamespace(name), labels
 	}
 
-	return labels
+	// Or just return as a single, valid name
+	return c.withNamespace(PrometheusNameSanitizer.SanitizeMetricName(strings.ToLower(counter.Name))), labels
+}
+
+func hasPrometheusLabel(labels []PrometheusLabel, name string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts names of configuration sections like rules.0, rules.1, ... rules.10 in numeric order
+func sortConfigSectionNames(names []string) []string {
+	sort.SliceStable(names, func(i, j int) bool {
+		left, leftErr := strconv.Atoi(names[i])
+		right, rightErr := strconv.Atoi(names[j])
+		if leftErr != nil || rightErr != nil {
+			return names[i] < names[j]
+		}
+		return left < right
+	})
+	return names
 }
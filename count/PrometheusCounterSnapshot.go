@@ -0,0 +1,67 @@
+package count
+
+import (
+	"time"
+
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+)
+
+// PrometheusCounterSnapshot is a measurement of a performance counter extended
+// with the state that PrometheusCounters keeps for Prometheus exposition.
+type PrometheusCounterSnapshot struct {
+	ccount.Counter
+
+	// Labels identify the series of the counter recorded with labels (empty for plain counters).
+	Labels []PrometheusLabel `json:"labels"`
+	// Updated is the time of the last update of the counter (zero if it is unknown).
+	Updated time.Time `json:"updated"`
+	// Total is a cumulative value of Increment counter that is never reset by CachedCounters.
+	Total int64 `json:"total"`
+	// Created is the time when accumulation of Total or of cumulative statistics has started.
+	Created time.Time `json:"created"`
+	// Sum is a sum of values of Interval or Statistics counter.
+	Sum float64 `json:"sum"`
+	// Exemplar is the last exemplar of Increment counter (nil if there is none).
+	Exemplar *PrometheusExemplar `json:"exemplar"`
+	// Histogram is a histogram of Interval or Statistics counter values (nil if it isn't recorded).
+	Histogram *PrometheusHistogramSnapshot `json:"histogram"`
+	// Summary is a summary of Interval or Statistics counter values (nil if it isn't recorded).
+	Summary *PrometheusSummarySnapshot `json:"summary"`
+	// NativeHistogram is a native histogram of Interval or Statistics counter values (nil if it isn't recorded).
+	NativeHistogram *PrometheusNativeHistogramSnapshot `json:"native_histogram"`
+
+	// folded is set when the snapshot combines series over the limit,
+	// its name is a metric name and labels are already mapped
+	folded bool
+}
+
+// NewPrometheusCounterSnapshot creates a snapshot from a plain counter measurement.
+// The total of Increment counter is set to its current count
+// and the sum of Interval or Statistics counter is calculated from its average.
+//	Parameters:
+//		- counter  a counter measurement.
+// Returns *PrometheusCounterSnapshot
+// pointer on new instance
+func NewPrometheusCounterSnapshot(counter ccount.Counter) *PrometheusCounterSnapshot {
+	snapshot := &PrometheusCounterSnapshot{
+		Counter: counter,
+		Total:   counter.Count,
+	}
+	if counter.Type == ccount.Interval || counter.Type == ccount.Statistics {
+		snapshot.Sum = counter.Average * float64(counter.Count)
+	}
+	return snapshot
+}
+
+// NewPrometheusCounterSnapshots creates snapshots from plain counter measurements.
+//	Parameters:
+//		- counters  counter measurements.
+// Returns []*PrometheusCounterSnapshot
+// created snapshots
+func NewPrometheusCounterSnapshots(counters []ccount.Counter) []*PrometheusCounterSnapshot {
+	snapshots := make([]*PrometheusCounterSnapshot, 0, len(counters))
+	for _, counter := range counters {
+		snapshots = append(snapshots, NewPrometheusCounterSnapshot(counter))
+	}
+	return snapshots
+}
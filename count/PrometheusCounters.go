@@ -1,16 +1,22 @@
 package count
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
 	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
 	cref "github.com/pip-services3-gox/pip-services3-commons-gox/refer"
+	cauth "github.com/pip-services3-gox/pip-services3-components-gox/auth"
 	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
 	cinfo "github.com/pip-services3-gox/pip-services3-components-gox/info"
 	clog "github.com/pip-services3-gox/pip-services3-components-gox/log"
@@ -21,6 +27,8 @@ import (
 //
 // The component is normally used in passive mode conjunction with PrometheusMetricsService.
 // Alternatively when connection parameters are set it can push metrics to Prometheus PushGateway.
+// A configured connection that can't be resolved, i.e. without host or port or with unsupported protocol,
+// fails Open with ConfigError. Earlier versions logged a warning and silently stayed in passive mode.
 //
 //	Configuration parameters:
 //
@@ -30,16 +38,125 @@ import (
 //			- host:                  host name or IP address
 //			- port:                  port number
 //			- uri:                   resource URI or connection string with all parameters in it
+//		- credential(s):
+//			- store_key:             (optional) a key to retrieve the credentials from ICredentialStore
+//			- username:              (optional) a user name for basic authentication on PushGateway
+//			- password:              (optional) a user password for basic authentication
+//			- access_token:          (optional) a bearer token sent instead of basic authentication
+//			- ssl_ca_file:           (optional) a PEM file with CA certificates trusted for HTTPS connections
+//			- ssl_crt_file:          (optional) a PEM file with a client certificate for mutual TLS
+//			- ssl_key_file:          (optional) a PEM file with a private key of the client certificate
 //		- options:
 //			- retries:               number of retries (default: 3)
 //			- connect_timeout:       connection timeout in milliseconds (default: 10 sec)
 //			- timeout:               invocation timeout in milliseconds (default: 10 sec)
+//			- tls_server_name:       (optional) a server name to verify the certificate of PushGateway against
+//			- tls_min_version:       minimum TLS version: 1.0, 1.1, 1.2 or 1.3 (default: 1.2)
+//			- push_format:           format of metrics pushed to PushGateway: text, protobuf or a format of referenced formatter except json (default: text)
+//			- push_method:           put to replace all metrics of the group or post to replace only metrics with the same names (default: put)
+//			- delete_on_close:       delete the group of metrics from PushGateway when the component is closed (default: false)
+//			- native_counters:       expose Increment counters as cumulative Prometheus counters with _total suffix (default: false)
+//			- histograms:            record all Interval and Statistics counters as histograms (default: false)
+//			- summaries:             record all Interval and Statistics counters as summaries (default: false)
+//			- native_histograms:     record all Interval and Statistics counters as native histograms (default: false)
+//			- exemplars:             attach trace and correlation ids from context to samples as exemplars (default: true)
+//			- temporality:           cumulative to accumulate values since counters were created or delta to reset them
+//			                         after reset_timeout as CachedCounters do (default: delta)
+//			- series_ttl:            time in milliseconds after which series that are not updated are removed, 0 to keep them (default: 0)
+//			- timestamp_age:         expose age of Timestamp counters as <name>_age_seconds gauges (default: false)
+//			- max_series:            maximum number of exposed series, 0 for unlimited (default: 0)
+//			- max_family_series:     maximum number of exposed series per metric family, 0 for unlimited (default: 0)
+//			- series_overflow:       what to do with series over the limits: drop or fold (default: drop)
+//			- namespace:             (optional) a prefix of all metric names, i.e. acme
+//			- subsystem:             (optional) a prefix of all metric names after the namespace, i.e. billing
+//		- labels:
+//			- <name>:                a constant label added to all series, i.e. labels.env=prod
+//		- grouping:
+//			- job:                   (optional) a job of pushed metrics (default: source or context name)
+//			- instance:              (optional) an instance of pushed metrics (default: instance, context id or host name)
+//			- <label>:               an extra label of the grouping key, i.e. grouping.tenant=acme
+//		- histogram:
+//			- buckets:               comma-separated upper bounds of histogram buckets (default: 5,10,25,50,100,250,500,1000,2500,5000,10000)
+//			- rules:
+//				- <index>:
+//					- pattern:           a template of counter names recorded as histograms, i.e. *.*.exec_time
+//					- buckets:           (optional) comma-separated upper bounds of buckets for matching counters
+//		- summary:
+//			- objectives:            comma-separated quantiles with allowed errors (default: 0.5:0.05,0.9:0.01,0.99:0.001)
+//			- max_age:               duration of the window in milliseconds quantiles are estimated for (default: 10 mins)
+//			- age_buckets:           number of buckets the window is rotated by (default: 5)
+//			- rules:
+//				- <index>:
+//					- pattern:           a template of counter names recorded as summaries
+//					- objectives:        (optional) comma-separated quantiles with allowed errors for matching counters
+//		- native_histogram:
+//			- schema:                resolution from -4 to 8, each power of 2 is divided into 2^schema buckets (default: 3)
+//			- zero_threshold:        width of the zero bucket (default: 2^-128)
+//			- max_buckets:           number of buckets after which the resolution is reduced (default: 160)
+//			- rules:
+//				- <index>:
+//					- pattern:           a template of counter names recorded as native histograms
+//					- schema:            (optional) resolution for matching counters
+//		- mapping:
+//			- rules:
+//				- <index>:
+//					- pattern:           a template where * matches one name segment, i.e. *.*.calls
+//					- regex:             (optional) a regular expression used instead of the template
+//					- name:              a metric name, i.e. calls_total
+//					- labels:            comma-separated label names for matched segments, i.e. service,command
+//		- metadata:
+//			- <counter>:                 a counter name or a template where * matches one name segment, i.e. *.*.calls
+//				- help:              a description of metrics of the counter shown in HELP lines
+//				- unit:              (optional) a unit of metrics, shown in OpenMetrics for names ending with _<unit>
+//				- type:              (optional) type of Increment, LastValue and Timestamp counters: counter, gauge or untyped
+//
+// In delta temporality values are exposed as they are kept by CachedCounters: Increment counts,
+// min, max and average of Interval and Statistics counters start over after reset_timeout.
+// In cumulative temporality Increment counters are exposed as Prometheus counters with _created timestamps,
+// and Interval and Statistics counters without histograms or summaries are exposed as summaries
+// with _count, _sum and _created and <name>_max and <name>_min gauges of all values since the counter was created.
+// Labeled series are always cumulative.
+//
+// Metrics are pushed to the group of the job, instance and extra grouping labels sorted by names on PushGateway.
+// Values with slashes and empty values are encoded in the URL as <label>@base64/<value> as PushGateway requires. The group is kept on the gateway
+// after the process exits unless delete_on_close is set, which is useful for short-lived workers.
+//
+// TLS settings are loaded when the component is opened. Missing or invalid certificate files fail Open
+// with ConnectionError. Without a CA file certificates of PushGateway are verified against system roots.
+// HTTPS connections don't require client certificates, ssl_crt_file and ssl_key_file are only needed for mutual TLS
+// and they shall be set together.
+//
+// Pushes and deletions are authenticated by Authorization header: a bearer token when access_token is set,
+// otherwise basic authentication when username is set. Credentials are never written to logs.
+//
+// When series_ttl is set counters and labeled series that were not updated within the TTL
+// don't appear in scrape and push output. They are removed from the component on the next Save,
+// which is called on dumps also in passive mode, or when their places are needed for new series.
+//
+// Counters can be recorded with labels by IncrementWithLabels, StatsWithLabels, BeginTimingWithLabels and similar methods.
+// Each distinct set of labels is a separate series of one metric family. Labeled series are not reset by reset_timeout,
+// they are kept until the counter is cleared.
+//
+// Series are admitted under the limits in the order they are written and stay exposed until counters are cleared.
+// Series over the limits are checked when they are written, so they are not kept: they are dropped or folded
+// into one series per family where labels get "other" value. Each overflow is logged once per family and
+// each distinct rejected series is counted once in prometheus_series_overflow metric with family label.
+//
+// Exemplars are taken from trace and correlation ids added to the context by AddTraceIdToContext
+// and AddCorrelationIdToContext. They are attached to Increment counters exposed with native_counters
+// and to histogram buckets, and they appear in OpenMetrics and protobuf formats only.
+//
+// When a counter is recorded both as histogram and summary only the histogram is exposed.
+// Native histograms are only exposed in protobuf format, so they shall be pushed with push_format=protobuf
+// and scraped by Prometheus with native histograms feature enabled. Other formats only show their count and sum.
 //
 //	References:
 //
 //		- *:logger:*:*:1.0         (optional) ILogger components to pass log messages
 //		- *:counters:*:*:1.0         (optional) ICounters components to pass collected measurements
 //		- *:discovery:*:*:1.0        (optional)  IDiscovery services to resolve connection
+//		- *:credential-store:*:*:1.0 (optional)  ICredentialStore components to resolve credentials
+//		- *:prometheus-formatter:*:*:1.0  (optional)  IPrometheusFormatter components that replace or add exposition formats
 //
 // See:  RestService
 // See:  CommandableHttpService
@@ -60,12 +177,17 @@ import (
 //		    ...
 //		timing.EndTiming(ctx);
 //
+//		counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"method": "GET", "route": "/users", "status": "200"}, 1);
+//
 //		counters.Dump(ctx);
 //
 type PrometheusCounters struct {
 	*ccount.CachedCounters
 	logger             *clog.CompositeLogger
+	converter          *TPrometheusCounterConverter
 	connectionResolver *rpcconnect.HttpConnectionResolver
+	authorization      string
+	tlsOptions         *prometheusTlsOptions
 	opened             bool
 	source             string
 	instance           string
@@ -75,10 +197,47 @@ type PrometheusCounters struct {
 	retries            int
 	connectTimeout     int
 	uri                string
+	pushFormat         string
+	pushMethod         string
+	deleteOnClose      bool
+	grouping           map[string]string
+	totals             map[string]*prometheusTotal
+	histogramOptions   *prometheusHistogramOptions
+	histograms         map[string]*prometheusHistogram
+	summaryOptions     *prometheusSummaryOptions
+	summaries          map[string]*prometheusSummary
+	nativeOptions      *prometheusNativeHistogramOptions
+	nativeHistograms   map[string]*prometheusNativeHistogram
+	series             map[string]*prometheusSeries
+	limiter            *prometheusSeriesLimiter
+	admissions         map[string]prometheusAdmission
+	nextExpiry         time.Time
+	seriesUpdated      bool
+	lastSeriesDump     time.Time
+	interval           int64
+	exemplars          bool
+	seriesTtl          int64
+	updated            map[string]time.Time
+	cumulative         bool
+	stats              map[string]*prometheusStats
+	stateLock          sync.Mutex
 
 	Lock sync.Mutex
 }
 
+// prometheusAdmission is a place taken by a counter or a labeled series under series limits
+type prometheusAdmission struct {
+	family    string
+	signature string
+}
+
+// prometheusTotal is a cumulative value of Increment counter
+type prometheusTotal struct {
+	value    int64
+	created  time.Time
+	exemplar *PrometheusExemplar
+}
+
 // NewPrometheusCounters is creates a new instance of the performance counters.
 // Returns *PrometheusCounters
 // pointer on new instance
@@ -86,11 +245,31 @@ func NewPrometheusCounters() *PrometheusCounters {
 	c := PrometheusCounters{}
 	c.CachedCounters = ccount.InheritCacheCounters(&c)
 	c.logger = clog.NewCompositeLogger()
+	c.converter = NewPrometheusCounterConverter()
 	c.connectionResolver = rpcconnect.NewHttpConnectionResolver()
+	c.tlsOptions = &prometheusTlsOptions{}
 	c.opened = false
 	c.timeout = 10000
 	c.retries = 3
 	c.connectTimeout = 10000
+	c.pushFormat = PrometheusTextFormat
+	c.pushMethod = http.MethodPut
+	c.grouping = make(map[string]string)
+	c.totals = make(map[string]*prometheusTotal)
+	c.histogramOptions = newPrometheusHistogramOptions()
+	c.histograms = make(map[string]*prometheusHistogram)
+	c.summaryOptions = newPrometheusSummaryOptions()
+	c.summaries = make(map[string]*prometheusSummary)
+	c.nativeOptions = newPrometheusNativeHistogramOptions()
+	c.nativeHistograms = make(map[string]*prometheusNativeHistogram)
+	c.stats = make(map[string]*prometheusStats)
+	c.series = make(map[string]*prometheusSeries)
+	c.limiter = newPrometheusSeriesLimiter()
+	c.admissions = make(map[string]prometheusAdmission)
+	c.lastSeriesDump = time.Now()
+	c.interval = ccount.DefaultInterval
+	c.exemplars = true
+	c.updated = make(map[string]time.Time)
 	return &c
 }
 
@@ -102,12 +281,65 @@ func NewPrometheusCounters() *PrometheusCounters {
 func (c *PrometheusCounters) Configure(ctx context.Context, config *cconf.ConfigParams) {
 	c.CachedCounters.Configure(ctx, config)
 	c.connectionResolver.Configure(ctx, config)
+	c.converter.Configure(ctx, config)
 
 	c.source = config.GetAsStringWithDefault("source", c.source)
 	c.instance = config.GetAsStringWithDefault("instance", c.instance)
 	c.retries = config.GetAsIntegerWithDefault("options.retries", c.retries)
 	c.connectTimeout = config.GetAsIntegerWithDefault("options.connectTimeout", c.connectTimeout)
 	c.timeout = config.GetAsIntegerWithDefault("options.timeout", c.timeout)
+	c.tlsOptions.serverName = config.GetAsStringWithDefault("options.tls_server_name", c.tlsOptions.serverName)
+	c.tlsOptions.minVersion = config.GetAsStringWithDefault("options.tls_min_version", c.tlsOptions.minVersion)
+	// PushGateway doesn't accept JSON, it is only a view for debugging
+	pushFormat := config.GetAsStringWithDefault("options.push_format", c.pushFormat)
+	if !strings.EqualFold(pushFormat, PrometheusJsonFormat) {
+		c.pushFormat = pushFormat
+	} else {
+		c.logger.Error(ctx, "prometheus-counters", cerr.NewConfigError("", "INVALID_PUSH_FORMAT",
+			"Metrics can't be pushed in JSON format").WithDetails("format", pushFormat), "Invalid push configuration")
+	}
+	c.deleteOnClose = config.GetAsBooleanWithDefault("options.delete_on_close", c.deleteOnClose)
+	// Grouping key is replaced as a whole, so labels removed from the configuration don't stay in the route
+	c.grouping = make(map[string]string)
+	grouping := config.GetSection("grouping")
+	for _, name := range grouping.Keys() {
+		if !PrometheusNameSanitizer.IsValidLabelName(name) {
+			c.logger.Error(ctx, "prometheus-counters", cerr.NewConfigError("", "INVALID_GROUPING_LABEL",
+				"Invalid name of grouping label").WithDetails("label", name), "Invalid push configuration")
+			continue
+		}
+		c.grouping[name] = grouping.GetAsString(name)
+	}
+	pushMethod := strings.ToUpper(config.GetAsStringWithDefault("options.push_method", c.pushMethod))
+	if pushMethod == http.MethodPut || pushMethod == http.MethodPost {
+		c.pushMethod = pushMethod
+	} else {
+		c.logger.Error(ctx, "prometheus-counters", cerr.NewConfigError("", "INVALID_PUSH_METHOD",
+			"Push method shall be put or post").WithDetails("method", pushMethod), "Invalid push configuration")
+	}
+	c.stateLock.Lock()
+	c.interval = config.GetAsLongWithDefault(ccount.ConfigParameterInterval, c.interval)
+	c.exemplars = config.GetAsBooleanWithDefault("options.exemplars", c.exemplars)
+	c.seriesTtl = config.GetAsLongWithDefault("options.series_ttl", c.seriesTtl)
+	c.nextExpiry = time.Time{}
+	c.cumulative = config.GetAsStringWithDefault("options.temporality", c.temporality()) == PrometheusCumulativeTemporality
+	histogramErr := c.histogramOptions.configure(config)
+	summaryErr := c.summaryOptions.configure(config)
+	nativeErr := c.nativeOptions.configure(config)
+	limiterErr := c.limiter.configure(config)
+	c.stateLock.Unlock()
+	if histogramErr != nil {
+		c.logger.Error(ctx, "prometheus-counters", histogramErr, "Invalid histogram configuration")
+	}
+	if summaryErr != nil {
+		c.logger.Error(ctx, "prometheus-counters", summaryErr, "Invalid summary configuration")
+	}
+	if nativeErr != nil {
+		c.logger.Error(ctx, "prometheus-counters", nativeErr, "Invalid native histogram configuration")
+	}
+	if limiterErr != nil {
+		c.logger.Error(ctx, "prometheus-counters", limiterErr, "Invalid series limits configuration")
+	}
 }
 
 // SetReferences method are sets references to dependent components.
@@ -117,6 +349,7 @@ func (c *PrometheusCounters) Configure(ctx context.Context, config *cconf.Config
 // references to locate the component dependencies.
 func (c *PrometheusCounters) SetReferences(ctx context.Context, references cref.IReferences) {
 	c.logger.SetReferences(ctx, references)
+	c.converter.SetReferences(ctx, references)
 	c.connectionResolver.SetReferences(ctx, references)
 	ref := references.GetOneOptional(
 		cref.NewDescriptor("pip-services", "context-info", "default", "*", "1.0"))
@@ -147,33 +380,48 @@ func (c *PrometheusCounters) Open(ctx context.Context, correlationId string) (er
 	}
 
 	c.opened = true
-	connection, _, err := c.connectionResolver.Resolve(correlationId)
 
-	c.Lock.Lock()
+	// Credentials and certificates are checked first, so they are reported before connection errors
+	credential, err := c.connectionResolver.CredentialResolver.Lookup(ctx, correlationId)
+	if err != nil {
+		c.opened = false
+		c.logger.Error(ctx, correlationId, err, "Failed to resolve credentials of Prometheus server")
+		return err
+	}
+	tlsConfig, err := c.tlsOptions.tlsConfig(correlationId, credential)
 	if err != nil {
+		c.opened = false
+		c.logger.Error(ctx, correlationId, err, "Failed to configure TLS connection to Prometheus server")
+		return err
+	}
+
+	// Without connection the counters work in passive mode with PrometheusMetricsService
+	if len(c.connectionResolver.ConnectionResolver.GetAll()) == 0 {
+		c.Lock.Lock()
 		c.client = nil
 		c.Lock.Unlock()
-		c.logger.Warn(ctx, correlationId, "Connection to Prometheus server is not configured: "+err.Error())
+		c.logger.Warn(ctx, correlationId, "Connection to Prometheus server is not configured")
 		return nil
 	}
 
-	c.Lock.Unlock()
-	c.uri = connection.Uri()
-
-	job := c.source
-	if job == "" {
-		job = "unknown"
+	uri, err := c.resolveUri(correlationId)
+	if err != nil {
+		c.opened = false
+		c.logger.Error(ctx, correlationId, err, "Failed to resolve connection to Prometheus server")
+		return err
 	}
+	c.uri = uri
+	c.authorization = prometheusAuthorization(credential)
 
-	instance := c.instance
-	if instance == "" {
-		host, _ := os.Hostname()
-		instance = host
-	}
-	c.requestRoute = "/metrics/job/" + job + "/instance/" + instance
+	c.requestRoute = c.groupingRoute()
 
 	localClient := http.Client{}
 	localClient.Timeout = (time.Duration)(c.timeout) * time.Millisecond
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		localClient.Transport = transport
+	}
 
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
@@ -187,6 +435,7 @@ func (c *PrometheusCounters) Open(ctx context.Context, correlationId string) (er
 }
 
 // Close method are closes component and frees used resources.
+// When delete_on_close is set it deletes the group of pushed metrics from PushGateway.
 //	Parameters:
 //		- ctx context.Context	operation context
 //		- correlationId string (optional) transaction id to trace execution through call chain.
@@ -196,20 +445,148 @@ func (c *PrometheusCounters) Close(ctx context.Context, correlationId string) er
 	c.opened = false
 
 	c.Lock.Lock()
+	client := c.client
 	c.client = nil
 	c.Lock.Unlock()
 
+	var err error
+	if client != nil && c.deleteOnClose {
+		err = c.deleteGroup(ctx, correlationId, client, c.uri+c.requestRoute)
+	}
+
 	c.requestRoute = ""
+	c.authorization = ""
+	return err
+}
+
+// Resolves the connection and composes URI of PushGateway.
+// HTTPS requirements are checked by TLS settings, so unlike HttpConnectionResolver
+// it doesn't require client certificates for HTTPS connections set by protocol, host and port.
+func (c *PrometheusCounters) resolveUri(correlationId string) (string, error) {
+	connection, err := c.connectionResolver.ConnectionResolver.Resolve(correlationId)
+	if err != nil {
+		return "", err
+	}
+	if connection == nil {
+		return "", cerr.NewConfigError(correlationId, "NO_CONNECTION", "HTTP connection is not set")
+	}
+	if uri := connection.Uri(); uri != "" {
+		return uri, nil
+	}
+
+	protocol := connection.Protocol()
+	if protocol != "http" && protocol != "https" {
+		return "", cerr.NewConfigError(correlationId, "WRONG_PROTOCOL", "Protocol is not supported by REST connection").
+			WithDetails("protocol", protocol)
+	}
+	if connection.Host() == "" {
+		return "", cerr.NewConfigError(correlationId, "NO_HOST", "Connection host is not set")
+	}
+	if connection.Port() == 0 {
+		return "", cerr.NewConfigError(correlationId, "NO_PORT", "Connection port is not set")
+	}
+	return protocol + "://" + connection.Host() + ":" + strconv.Itoa(connection.Port()), nil
+}
+
+// Composes Authorization header from access token or user name and password
+func prometheusAuthorization(credential *cauth.CredentialParams) string {
+	if credential == nil {
+		return ""
+	}
+	if token := credential.GetAsString("access_token"); token != "" {
+		return "Bearer " + token
+	}
+	if username := credential.Username(); username != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+credential.Password()))
+	}
+	return ""
+}
+
+// Composes the path of the group of pushed metrics: /metrics/job/<job>/instance/<instance>/<label>/<value>...
+func (c *PrometheusCounters) groupingRoute() string {
+	job, ok := c.grouping["job"]
+	if !ok || job == "" {
+		job = c.source
+	}
+	if job == "" {
+		job = "unknown"
+	}
+
+	instance, ok := c.grouping["instance"]
+	if !ok {
+		instance = c.instance
+	}
+	if !ok && instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	names := make([]string, 0, len(c.grouping))
+	for name := range c.grouping {
+		if name != "job" && name != "instance" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	route := "/metrics" + prometheusGroupingSegment("job", job) + prometheusGroupingSegment("instance", instance)
+	for _, name := range names {
+		route += prometheusGroupingSegment(name, c.grouping[name])
+	}
+	return route
+}
+
+// Encodes a label of the grouping key as a pair of path segments.
+// Empty values and values with slashes are encoded in base64 as PushGateway requires.
+func prometheusGroupingSegment(name string, value string) string {
+	if value == "" {
+		return "/" + name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// Sends DELETE request to remove the group of metrics from PushGateway
+func (c *PrometheusCounters) deleteGroup(ctx context.Context, correlationId string, client *http.Client, url string) error {
+	var resp *http.Response
+	var respErr error
+
+	for retries := c.retries; retries > 0; retries-- {
+		req, reqErr := http.NewRequest(http.MethodDelete, url, nil)
+		if reqErr != nil {
+			return cerr.NewUnknownError(correlationId, "UNSUPPORTED_METHOD", "Method is not supported by REST client").WithDetails("verb", "DELETE").WithCause(reqErr)
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
+		resp, respErr = client.Do(req)
+		if respErr == nil {
+			break
+		}
+	}
+	if respErr != nil {
+		return cerr.NewUnknownError(correlationId, "COMMUNICATION_ERROR", "Unknown communication problem on REST client").WithCause(respErr)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		c.logger.Warn(ctx, correlationId, "Failed to delete metrics from PushGateway: status %d", resp.StatusCode)
+	}
 	return nil
 }
 
 // Save method are saves the current counters measurements.
+// After the push it removes counters and series that were not updated within series_ttl.
 //	Parameters:
 //		- ctx context.Context	operation context
 //		- counters   []ccount.Counter current counters measurements to be saves.
 // Retruns error
-// error or nil, if no errors occured.
+// error or nil, if no errors occured. A response with non-2xx status is returned as error with the status and body.
 func (c *PrometheusCounters) Save(cxt context.Context, counters []ccount.Counter) (err error) {
+	defer c.expire(cxt)
+
 	c.Lock.Lock()
 	if c.client == nil {
 		c.Lock.Unlock()
@@ -217,24 +594,45 @@ func (c *PrometheusCounters) Save(cxt context.Context, counters []ccount.Counter
 	}
 	c.Lock.Unlock()
 
+	// Labeled series are pushed together with counters
+	c.stateLock.Lock()
+	c.seriesUpdated = false
+	c.stateLock.Unlock()
+
 	url := c.uri + c.requestRoute
 
-	body := PrometheusCounterConverter.ToString(counters, "", "")
+	families := c.converter.SnapshotsToFamilies(c.snapshots(counters), "", "")
+	formatter := c.converter.Formatter(c.pushFormat)
 
-	req, reqErr := http.NewRequest(http.MethodPut, url, bytes.NewBuffer([]byte(body)))
-	if reqErr != nil {
-		err = cerr.NewUnknownError("PrometheusCounters", "UNSUPPORTED_METHOD", "Method is not supported by REST client").WithDetails("verb", "PUT").WithCause(reqErr)
-		return err
-	}
-	// Set headers
-	req.Header.Set("Accept", "text/html")
 	retries := c.retries
+	var req *http.Request
 	var resp *http.Response
 	var respErr error
 
 	for retries > 0 {
+		// Metrics are streamed into the request body, each attempt gets a new body
+		body, bodyWriter := io.Pipe()
+		go func() {
+			bodyWriter.CloseWithError(formatter.Write(bodyWriter, families))
+		}()
+
+		var reqErr error
+		req, reqErr = http.NewRequest(c.pushMethod, url, body)
+		if reqErr != nil {
+			body.Close()
+			err = cerr.NewUnknownError("PrometheusCounters", "UNSUPPORTED_METHOD", "Method is not supported by REST client").WithDetails("verb", c.pushMethod).WithCause(reqErr)
+			return err
+		}
+		// Set headers
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set("Content-Type", formatter.ContentType())
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
 		// Try send request
 		resp, respErr = c.client.Do(req)
+		body.Close()
 		if respErr != nil {
 
 			retries--
@@ -247,13 +645,767 @@ func (c *PrometheusCounters) Save(cxt context.Context, counters []ccount.Counter
 		}
 		break
 	}
-	if resp != nil {
-		defer resp.Body.Close()
-		if resp.StatusCode >= 204 && resp.StatusCode < 300 {
+	if resp == nil {
+		return nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	// Error responses are short, the body is read only to describe the failure
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = cerr.NewUnknownError("PrometheusCounters", "PUSH_FAILED", "Failed to push metrics to Prometheus: status "+strconv.Itoa(resp.StatusCode)).
+		WithDetails("status", resp.StatusCode).
+		WithDetails("body", strings.TrimSpace(string(message)))
+	c.logger.Error(req.Context(), "prometheus-counters", err, "Failed to push metrics to prometheus")
+	return err
+}
+
+// IncrementOne increments counter by 1.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Increment type.
+func (c *PrometheusCounters) IncrementOne(ctx context.Context, name string) {
+	c.Increment(ctx, name, 1)
+}
+
+// Increment increments counter by given value.
+// Besides the value kept by CachedCounters it accumulates a total that is not reset between dumps.
+// When the context has a trace or correlation id it is kept as an exemplar of the counter.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Increment type.
+//		- value int64 a value to add to the counter.
+func (c *PrometheusCounters) Increment(ctx context.Context, name string, value int64) {
+	if name == "" {
+		return
+	}
+
+	exemplar := c.exemplar(ctx, float64(value))
+
+	c.stateLock.Lock()
+	if !c.admitCounter(ctx, name, ccount.Increment) {
+		c.stateLock.Unlock()
+		return
+	}
+	total, ok := c.totals[name]
+	if !ok {
+		total = &prometheusTotal{created: time.Now()}
+		c.totals[name] = total
+	}
+	total.value += value
+	if exemplar != nil {
+		total.exemplar = exemplar
+	}
+	c.updated[name] = time.Now()
+	c.stateLock.Unlock()
+
+	c.CachedCounters.Increment(ctx, name, value)
+}
+
+// BeginTiming begins measurement of execution time interval.
+// It returns Timing object which has to be called at
+// Timing.EndTiming to end the measurement and update the counter.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Interval type.
+// Returns *ccount.CounterTiming
+// a Timing callback object to end timing.
+func (c *PrometheusCounters) BeginTiming(ctx context.Context, name string) *ccount.CounterTiming {
+	return ccount.NewCounterTiming(name, c)
+}
+
+// EndTiming ends measurement of execution elapsed time and updates specified counter.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name
+//		- elapsed float64 execution elapsed time in milliseconds to update the counter.
+func (c *PrometheusCounters) EndTiming(ctx context.Context, name string, elapsed float64) {
+	if c.observe(ctx, name, ccount.Interval, elapsed) {
+		c.CachedCounters.EndTiming(ctx, name, elapsed)
+	}
+}
+
+// Stats calculates min/average/max statistics based on the current and previous values.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Statistics type
+//		- value float64 a value to update statistics
+func (c *PrometheusCounters) Stats(ctx context.Context, name string, value float64) {
+	if c.observe(ctx, name, ccount.Statistics, value) {
+		c.CachedCounters.Stats(ctx, name, value)
+	}
+}
+
+// Last records the last calculated measurement value.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Last type.
+//		- value float64 a last value to record.
+func (c *PrometheusCounters) Last(ctx context.Context, name string, value float64) {
+	if c.touch(ctx, name, ccount.LastValue) {
+		c.CachedCounters.Last(ctx, name, value)
+	}
+}
+
+// TimestampNow records the current time as a timestamp.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Timestamp type.
+func (c *PrometheusCounters) TimestampNow(ctx context.Context, name string) {
+	c.Timestamp(ctx, name, time.Now())
+}
+
+// Timestamp records the given timestamp.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Timestamp type.
+//		- value time.Time a timestamp to record.
+func (c *PrometheusCounters) Timestamp(ctx context.Context, name string, value time.Time) {
+	if c.touch(ctx, name, ccount.Timestamp) {
+		c.CachedCounters.Timestamp(ctx, name, value)
+	}
+}
+
+// Remembers the time of the last update of the counter.
+// Returns false if the counter is dropped by series limits
+func (c *PrometheusCounters) touch(ctx context.Context, name string, typ ccount.CounterType) bool {
+	if name == "" {
+		return false
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if !c.admitCounter(ctx, name, typ) {
+		return false
+	}
+	c.updated[name] = time.Now()
+	return true
+}
+
+// Records the value into histograms and summary when they are enabled for the counter
+// and into cumulative statistics in cumulative temporality.
+// Returns false if the counter is dropped by series limits
+func (c *PrometheusCounters) observe(ctx context.Context, name string, typ ccount.CounterType, value float64) bool {
+	if name == "" {
+		return false
+	}
+
+	c.stateLock.Lock()
+	if !c.admitCounter(ctx, name, typ) {
+		c.stateLock.Unlock()
+		return false
+	}
+	c.updated[name] = time.Now()
+	if c.cumulative {
+		stats, ok := c.stats[name]
+		if !ok || stats.typ != typ {
+			stats = newPrometheusStats(typ)
+			c.stats[name] = stats
+		}
+		stats.observe(value)
+	}
+	histogram, ok := c.histograms[name]
+	if !ok {
+		if histogram = c.histogramFor(name); histogram != nil {
+			c.histograms[name] = histogram
+		}
+	}
+	summary, ok := c.summaries[name]
+	if !ok {
+		if summary = c.summaryOptions.summaryFor(name); summary != nil {
+			c.summaries[name] = summary
+		}
+	}
+	native, ok := c.nativeHistograms[name]
+	if !ok {
+		if native = c.nativeOptions.histogramFor(name); native != nil {
+			c.nativeHistograms[name] = native
+		}
+	}
+	c.stateLock.Unlock()
+
+	if histogram != nil {
+		histogram.observe(value, c.exemplar(ctx, value))
+	}
+	if summary != nil {
+		summary.observe(value)
+	}
+	if native != nil {
+		native.observe(value)
+	}
+	return true
+}
+
+// Creates an exemplar from trace and correlation ids in the context when exemplars are enabled
+func (c *PrometheusCounters) exemplar(ctx context.Context, value float64) *PrometheusExemplar {
+	c.stateLock.Lock()
+	enabled := c.exemplars
+	c.stateLock.Unlock()
+
+	if !enabled {
+		return nil
+	}
+	return newPrometheusExemplar(ctx, value)
+}
+
+// IncrementWithTraceId increments counter by given value and attaches the trace id to its exemplar.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Increment type.
+//		- value int64 a value to add to the counter.
+//		- traceId string a trace id of the request that updated the counter.
+func (c *PrometheusCounters) IncrementWithTraceId(ctx context.Context, name string, value int64, traceId string) {
+	c.Increment(AddTraceIdToContext(ctx, traceId), name, value)
+}
+
+// EndTimingWithTraceId ends measurement of execution elapsed time, updates specified counter
+// and attaches the trace id to the exemplar of the histogram bucket.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name
+//		- elapsed float64 execution elapsed time in milliseconds to update the counter.
+//		- traceId string a trace id of the timed request.
+func (c *PrometheusCounters) EndTimingWithTraceId(ctx context.Context, name string, elapsed float64, traceId string) {
+	c.EndTiming(AddTraceIdToContext(ctx, traceId), name, elapsed)
+}
+
+// Gets temporality of exposed values. It shall be called under the state lock.
+func (c *PrometheusCounters) temporality() string {
+	if c.cumulative {
+		return PrometheusCumulativeTemporality
+	}
+	return PrometheusDeltaTemporality
+}
+
+// Creates a histogram for the counter if histograms are enabled for it
+func (c *PrometheusCounters) histogramFor(name string) *prometheusHistogram {
+	if buckets := c.histogramOptions.bucketsFor(name); buckets != nil {
+		return newPrometheusHistogram(buckets)
+	}
+	return nil
+}
+
+// IncrementOneWithLabels increments a labeled series of the counter by 1.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Increment type.
+//		- labels map[string]string labels that identify the series.
+func (c *PrometheusCounters) IncrementOneWithLabels(ctx context.Context, name string, labels map[string]string) {
+	c.IncrementWithLabels(ctx, name, labels, 1)
+}
+
+// IncrementWithLabels increments a labeled series of the counter by given value.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Increment type.
+//		- labels map[string]string labels that identify the series.
+//		- value int64 a value to add to the counter.
+func (c *PrometheusCounters) IncrementWithLabels(ctx context.Context, name string, labels map[string]string, value int64) {
+	if name == "" {
+		return
+	}
+
+	exemplar := c.exemplar(ctx, float64(value))
+
+	c.stateLock.Lock()
+	series := c.getSeries(ctx, name, ccount.Increment, labels)
+	if series == nil {
+		c.stateLock.Unlock()
+		return
+	}
+	series.total.value += value
+	if exemplar != nil {
+		series.total.exemplar = exemplar
+	}
+	c.stateLock.Unlock()
+
+	series.counter.Inc(value)
+	c.updateSeries(ctx)
+}
+
+// BeginTimingWithLabels begins measurement of execution time interval for a labeled series.
+// It returns Timing object which has to be called at
+// Timing.EndTiming to end the measurement and update the series.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Interval type.
+//		- labels map[string]string labels that identify the series.
+// Returns *ccount.CounterTiming
+// a Timing callback object to end timing.
+func (c *PrometheusCounters) BeginTimingWithLabels(ctx context.Context, name string, labels map[string]string) *ccount.CounterTiming {
+	return ccount.NewCounterTiming(name, &prometheusLabeledTiming{counters: c, labels: labels})
+}
+
+// EndTimingWithLabels ends measurement of execution elapsed time and updates a labeled series of the counter.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name
+//		- labels map[string]string labels that identify the series.
+//		- elapsed float64 execution elapsed time in milliseconds to update the counter.
+func (c *PrometheusCounters) EndTimingWithLabels(ctx context.Context, name string, labels map[string]string, elapsed float64) {
+	c.observeSeries(ctx, name, ccount.Interval, labels, elapsed)
+}
+
+// StatsWithLabels calculates min/average/max statistics of a labeled series of the counter.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Statistics type
+//		- labels map[string]string labels that identify the series.
+//		- value float64 a value to update statistics
+func (c *PrometheusCounters) StatsWithLabels(ctx context.Context, name string, labels map[string]string, value float64) {
+	c.observeSeries(ctx, name, ccount.Statistics, labels, value)
+}
+
+// LastWithLabels records the last calculated measurement value of a labeled series of the counter.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name of Last type.
+//		- labels map[string]string labels that identify the series.
+//		- value float64 a last value to record.
+func (c *PrometheusCounters) LastWithLabels(ctx context.Context, name string, labels map[string]string, value float64) {
+	if name == "" {
+		return
+	}
+
+	c.stateLock.Lock()
+	series := c.getSeries(ctx, name, ccount.LastValue, labels)
+	c.stateLock.Unlock()
+	if series == nil {
+		return
+	}
+
+	series.counter.SetLast(value)
+	c.updateSeries(ctx)
+}
+
+// Records the value into a labeled series of Interval or Statistics type
+func (c *PrometheusCounters) observeSeries(ctx context.Context, name string, typ ccount.CounterType, labels map[string]string, value float64) {
+	if name == "" {
+		return
+	}
+
+	c.stateLock.Lock()
+	series := c.getSeries(ctx, name, typ, labels)
+	c.stateLock.Unlock()
+	if series == nil {
+		return
+	}
+
+	series.counter.CalculateStats(value)
+	if series.histogram != nil {
+		series.histogram.observe(value, c.exemplar(ctx, value))
+	}
+	if series.summary != nil {
+		series.summary.observe(value)
+	}
+	if series.native != nil {
+		series.native.observe(value)
+	}
+	c.updateSeries(ctx)
+}
+
+// Gets or creates a labeled series. The series is recreated when its type changes.
+// New series over the limits are folded into the series with "other" label values or dropped.
+// It shall be called under the state lock.
+// Returns the series or nil if it is dropped
+func (c *PrometheusCounters) getSeries(ctx context.Context, name string, typ ccount.CounterType, labels map[string]string) *prometheusSeries {
+	sorted := prometheusLabelsFromMap(labels)
+	key := prometheusSeriesKey(name, sorted)
+
+	series, ok := c.series[key]
+	if !ok && !c.admitSeries(ctx, name, typ, sorted) {
+		if c.limiter.overflow != PrometheusSeriesOverflowFold {
 			return nil
 		}
-		c.logger.Error(req.Context(), "prometheus-counters", respErr, "Failed to push metrics to prometheus")
+		sorted = foldPrometheusLabels(sorted)
+		key = prometheusSeriesKey(name, sorted)
+		series, ok = c.series[key]
+	}
+	if !ok || series.counter.Type() != typ {
+		series = newPrometheusSeries(name, typ, sorted)
+		if typ == ccount.Interval || typ == ccount.Statistics {
+			series.histogram = c.histogramFor(name)
+			series.summary = c.summaryOptions.summaryFor(name)
+			series.native = c.nativeOptions.histogramFor(name)
+		}
+		c.series[key] = series
+	}
+	series.updated = time.Now()
+	c.seriesUpdated = true
+	return series
+}
+
+// Checks if a plain counter can be recorded under the series limits.
+// Counters over the limits are recorded in fold mode to be folded when they are exposed.
+// It shall be called under the state lock.
+func (c *PrometheusCounters) admitCounter(ctx context.Context, name string, typ ccount.CounterType) bool {
+	return c.admitSeries(ctx, name, typ, nil) || c.limiter.overflow == PrometheusSeriesOverflowFold
+}
+
+// Checks a new counter or labeled series against the series limits when it is written
+// and counts it as rejected when it is over the limits. It shall be called under the state lock.
+// Returns true if the series is admitted or false if it is over the limits
+func (c *PrometheusCounters) admitSeries(ctx context.Context, name string, typ ccount.CounterType, labels []PrometheusLabel) bool {
+	if !c.limiter.enabled() {
+		return true
+	}
+	key := prometheusSeriesKey(name, labels)
+	if _, ok := c.admissions[key]; ok {
+		return true
+	}
+
+	snapshot := &PrometheusCounterSnapshot{Counter: ccount.Counter{Name: name, Type: typ}, Labels: labels}
+	family, mapped := c.converter.mapSnapshot(snapshot, "", "")
+	if family == "" {
+		return true
+	}
+	sortPrometheusLabels(mapped)
+	signature := prometheusLabelsSignature(mapped)
+	admitted := c.limiter.admit(family, signature)
+	// Expired series free their places before new series are rejected
+	if !admitted && c.seriesTtl > 0 && c.expireSeries(ctx) > 0 {
+		admitted = c.limiter.admit(family, signature)
+	}
+	if admitted {
+		c.admissions[key] = prometheusAdmission{family: family, signature: signature}
+		return true
+	}
+
+	if c.limiter.reject(family, signature) {
+		if c.limiter.overflow == PrometheusSeriesOverflowFold {
+			c.logger.Warn(ctx, "prometheus-counters",
+				"Series limit is reached in metric family %s, new series are folded into %s", family, PrometheusSeriesOverflowValue)
+		} else {
+			c.logger.Warn(ctx, "prometheus-counters",
+				"Series limit is reached in metric family %s, new series are dropped", family)
+		}
+	}
+	return false
+}
+
+// Removes counters and labeled series that were not updated within the TTL
+func (c *PrometheusCounters) expire(ctx context.Context) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.expireSeries(ctx)
+}
+
+// Removes counters and labeled series that were not updated within the TTL together with their state
+// and frees their places under the series limits. It shall be called under the state lock.
+// Returns the number of removed counters and series
+func (c *PrometheusCounters) expireSeries(ctx context.Context) int {
+	now := time.Now()
+	if c.seriesTtl <= 0 || now.Before(c.nextExpiry) {
+		return 0
+	}
+	ttl := time.Duration(c.seriesTtl) * time.Millisecond
+	deadline := now.Add(-ttl)
+
+	// Nothing expires before the oldest remaining update reaches the TTL
+	oldest := now
+	removed := 0
+	for name, updated := range c.updated {
+		if !updated.Before(deadline) {
+			if updated.Before(oldest) {
+				oldest = updated
+			}
+			continue
+		}
+		delete(c.totals, name)
+		delete(c.histograms, name)
+		delete(c.summaries, name)
+		delete(c.nativeHistograms, name)
+		delete(c.stats, name)
+		delete(c.updated, name)
+		c.releaseSeries(prometheusSeriesKey(name, nil))
+		c.CachedCounters.Clear(ctx, name)
+		removed++
+	}
+	for key, series := range c.series {
+		if !series.updated.Before(deadline) {
+			if series.updated.Before(oldest) {
+				oldest = series.updated
+			}
+			continue
+		}
+		delete(c.series, key)
+		c.releaseSeries(key)
+		removed++
+	}
+	c.nextExpiry = oldest.Add(ttl)
+	return removed
+}
+
+// Frees the place taken by the counter or labeled series under the series limits.
+// It shall be called under the state lock.
+func (c *PrometheusCounters) releaseSeries(key string) {
+	if admission, ok := c.admissions[key]; ok {
+		c.limiter.release(admission.family, admission.signature)
+		delete(c.admissions, key)
+	}
+}
+
+// Dumps counters when labeled series were updated and the dump interval has passed
+func (c *PrometheusCounters) updateSeries(ctx context.Context) {
+	c.stateLock.Lock()
+	dumpTime := c.lastSeriesDump.Add(time.Duration(c.interval) * time.Millisecond)
+	c.stateLock.Unlock()
+
+	if time.Now().After(dumpTime) {
+		_ = c.Dump(ctx)
+	}
+}
+
+// Dump saves the current values of counters when they or labeled series were updated.
+//	Parameters:
+//		- ctx context.Context	operation context
+// Returns error
+// error or nil, if no errors occured.
+func (c *PrometheusCounters) Dump(ctx context.Context) error {
+	c.stateLock.Lock()
+	c.lastSeriesDump = time.Now()
+	c.stateLock.Unlock()
+
+	// Cached counters are dumped first, so their dump state is reset after the push
+	if err := c.CachedCounters.Dump(ctx); err != nil {
+		return err
+	}
+
+	c.stateLock.Lock()
+	updated := c.seriesUpdated
+	c.stateLock.Unlock()
+
+	if !updated {
+		return nil
+	}
+	return c.Save(ctx, c.GetAllCountersStats())
+}
+
+// Clear clears (resets) a counter specified by its name.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- name string a counter name to clear.
+func (c *PrometheusCounters) Clear(ctx context.Context, name string) {
+	c.stateLock.Lock()
+	delete(c.totals, name)
+	delete(c.histograms, name)
+	delete(c.summaries, name)
+	delete(c.nativeHistograms, name)
+	delete(c.stats, name)
+	delete(c.updated, name)
+	c.releaseSeries(prometheusSeriesKey(name, nil))
+	for key, series := range c.series {
+		if series.counter.Name() == name {
+			delete(c.series, key)
+			c.releaseSeries(key)
+		}
+	}
+	c.stateLock.Unlock()
+
+	c.CachedCounters.Clear(ctx, name)
+}
+
+// ClearAll clears (resets) all counters.
+//	Parameters:
+//		- ctx context.Context	operation context
+func (c *PrometheusCounters) ClearAll(ctx context.Context) {
+	c.stateLock.Lock()
+	c.totals = make(map[string]*prometheusTotal)
+	c.histograms = make(map[string]*prometheusHistogram)
+	c.summaries = make(map[string]*prometheusSummary)
+	c.nativeHistograms = make(map[string]*prometheusNativeHistogram)
+	c.stats = make(map[string]*prometheusStats)
+	c.series = make(map[string]*prometheusSeries)
+	c.updated = make(map[string]time.Time)
+	c.admissions = make(map[string]prometheusAdmission)
+	c.nextExpiry = time.Time{}
+	c.limiter.reset()
+	c.stateLock.Unlock()
+
+	c.CachedCounters.ClearAll(ctx)
+}
+
+// Converter gets the converter that turns counters of the component into metric families.
+// PrometheusMetricsService takes settings that are not configured in the service from it.
+// Returns *TPrometheusCounterConverter
+// the converter of the component
+func (c *PrometheusCounters) Converter() *TPrometheusCounterConverter {
+	return c.converter
+}
+
+// Metadata gets a registry of HELP text, units and explicit types of counters.
+// Metadata registered here is used in pushed metrics and by PrometheusMetricsService.
+//
+// Example:
+//		counters.Metadata().Register("orders.*.calls", PrometheusMetadata{Help: "Number of calls", Type: PrometheusTypeCounter})
+// Returns *PrometheusMetadataRegistry
+// the registry of metadata
+func (c *PrometheusCounters) Metadata() *PrometheusMetadataRegistry {
+	return c.converter.Metadata()
+}
+
+// GetSnapshots gets current measurements of all counters together with the state kept
+// for Prometheus exposition, i.e. cumulative totals of Increment counters, histograms, summaries and labeled series.
+// It has no side effects, so scrapes don't change the state of the component.
+// Returns []*PrometheusCounterSnapshot
+// snapshots of all counters
+func (c *PrometheusCounters) GetSnapshots() []*PrometheusCounterSnapshot {
+	return c.snapshots(c.GetAllCountersStats())
+}
+
+func (c *PrometheusCounters) snapshots(counters []ccount.Counter) []*PrometheusCounterSnapshot {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	snapshots := c.collectSnapshots(counters)
+	if c.seriesTtl > 0 {
+		snapshots = c.liveSnapshots(snapshots)
+	}
+	if c.limiter.enabled() {
+		snapshots = c.limitSnapshots(snapshots)
+	}
+	return snapshots
+}
+
+// Collects snapshots of counters with the state kept by the component.
+// It shall be called under the state lock.
+func (c *PrometheusCounters) collectSnapshots(counters []ccount.Counter) []*PrometheusCounterSnapshot {
+	snapshots := make([]*PrometheusCounterSnapshot, 0, len(counters)+len(c.totals)+len(c.series))
+	found := make(map[string]bool, len(counters))
+	for _, counter := range counters {
+		snapshot := NewPrometheusCounterSnapshot(counter)
+		c.fillSnapshot(snapshot)
+		found[counter.Name] = true
+		snapshots = append(snapshots, snapshot)
+	}
+
+	// Totals, histograms and summaries outlive counters that were reset by CachedCounters
+	for name := range c.totals {
+		if !found[name] {
+			snapshot := &PrometheusCounterSnapshot{Counter: ccount.Counter{Name: name, Type: ccount.Increment}}
+			c.fillSnapshot(snapshot)
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	observed := make([]string, 0, len(c.histograms)+len(c.summaries)+len(c.nativeHistograms)+len(c.stats))
+	for name := range c.histograms {
+		observed = append(observed, name)
+	}
+	for name := range c.summaries {
+		observed = append(observed, name)
+	}
+	for name := range c.nativeHistograms {
+		observed = append(observed, name)
+	}
+	for name := range c.stats {
+		observed = append(observed, name)
+	}
+	for _, name := range observed {
+		if !found[name] {
+			typ := ccount.Interval
+			if stats, ok := c.stats[name]; ok {
+				typ = stats.typ
+			}
+			snapshot := &PrometheusCounterSnapshot{Counter: ccount.Counter{Name: name, Type: typ}}
+			c.fillSnapshot(snapshot)
+			found[name] = true
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		snapshots = append(snapshots, c.series[key].snapshot())
+	}
+
+	return snapshots
+}
+
+// Filters out snapshots of counters and series that were not updated within the TTL.
+// Their state is removed later by Save or when their places are needed for new series.
+// It shall be called under the state lock.
+func (c *PrometheusCounters) liveSnapshots(snapshots []*PrometheusCounterSnapshot) []*PrometheusCounterSnapshot {
+	deadline := time.Now().Add(-time.Duration(c.seriesTtl) * time.Millisecond)
+
+	result := make([]*PrometheusCounterSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot.Updated.IsZero() || !snapshot.Updated.Before(deadline) {
+			result = append(result, snapshot)
+		}
+	}
+	return result
+}
+
+// Applies series limits to plain counters and adds the self-metric of rejected series.
+// Labeled series are limited when they are written, while plain counters over the limits
+// are kept by CachedCounters in fold mode and are folded here. It shall be called under the state lock.
+func (c *PrometheusCounters) limitSnapshots(snapshots []*PrometheusCounterSnapshot) []*PrometheusCounterSnapshot {
+	constLabels := c.converter.ConstLabels()
+	fold := c.limiter.overflow == PrometheusSeriesOverflowFold
+
+	result := make([]*PrometheusCounterSnapshot, 0, len(snapshots))
+	folded := make(map[string]*PrometheusCounterSnapshot)
+	for _, snapshot := range snapshots {
+		if len(snapshot.Labels) > 0 {
+			result = append(result, snapshot)
+			continue
+		}
+		if _, ok := c.admissions[prometheusSeriesKey(snapshot.Name, nil)]; ok || !fold {
+			if ok {
+				result = append(result, snapshot)
+			}
+			continue
+		}
+
+		family, labels := c.converter.mapSnapshot(snapshot, "", "")
+		if family == "" {
+			continue
+		}
+		target := newPrometheusFoldedSnapshot(family, snapshot.Type, labels, constLabels)
+		key := strconv.Itoa(int(target.Type)) + "\xff" + family + prometheusLabelsSignature(target.Labels)
+		if existing, ok := folded[key]; ok {
+			mergePrometheusSnapshot(existing, snapshot, false)
+			continue
+		}
+		mergePrometheusSnapshot(target, snapshot, true)
+		folded[key] = target
+		result = append(result, target)
 	}
 
-	return respErr
+	return append(result, c.limiter.overflowSnapshots()...)
+}
+
+// Adds the state kept by the component to the snapshot
+func (c *PrometheusCounters) fillSnapshot(snapshot *PrometheusCounterSnapshot) {
+	snapshot.Updated = c.updated[snapshot.Name]
+	switch snapshot.Type {
+	case ccount.Increment:
+		if total, ok := c.totals[snapshot.Name]; ok {
+			snapshot.Total = total.value
+			snapshot.Created = total.created
+			snapshot.Exemplar = total.exemplar
+		}
+	case ccount.Interval, ccount.Statistics:
+		if stats, ok := c.stats[snapshot.Name]; ok && stats.typ == snapshot.Type {
+			stats.fill(snapshot)
+		}
+		if histogram, ok := c.histograms[snapshot.Name]; ok {
+			snapshot.Histogram = histogram.snapshot()
+		}
+		if summary, ok := c.summaries[snapshot.Name]; ok {
+			snapshot.Summary = summary.snapshot()
+		}
+		if native, ok := c.nativeHistograms[snapshot.Name]; ok {
+			snapshot.NativeHistogram = native.snapshot()
+		}
+	}
 }
@@ -0,0 +1,100 @@
+package count
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+)
+
+// PrometheusContextValueType is a type of keys of values that PrometheusCounters reads from context.
+type PrometheusContextValueType string
+
+const (
+	// PrometheusTraceIdType is a context key of a trace id attached to exemplars.
+	PrometheusTraceIdType PrometheusContextValueType = "pip.TraceId"
+	// PrometheusCorrelationIdType is a context key of a correlation id attached to exemplars.
+	PrometheusCorrelationIdType PrometheusContextValueType = "pip.CorrelationId"
+)
+
+// PrometheusExemplarMaxLength is a maximum combined length of exemplar label names and values
+// allowed by OpenMetrics.
+const PrometheusExemplarMaxLength = 128
+
+// PrometheusExemplar is a reference from a sample to a trace of the request that produced it.
+type PrometheusExemplar struct {
+	Labels    []PrometheusLabel `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// AddTraceIdToContext adds a trace id that is attached to exemplars of counters updated with the context.
+//	Parameters:
+//		- ctx      context.Context	a parent context.
+//		- traceId  string	a trace id.
+// Returns context.Context
+// a context with the trace id.
+func AddTraceIdToContext(ctx context.Context, traceId string) context.Context {
+	return context.WithValue(ctx, PrometheusTraceIdType, traceId)
+}
+
+// GetTraceIdFromContext gets a trace id from the context.
+//	Parameters:
+//		- ctx  context.Context	a context.
+// Returns string
+// the trace id or empty string if it isn't set.
+func GetTraceIdFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	value, _ := ctx.Value(PrometheusTraceIdType).(string)
+	return value
+}
+
+// AddCorrelationIdToContext adds a correlation id that is attached to exemplars of counters updated with the context.
+//	Parameters:
+//		- ctx            context.Context	a parent context.
+//		- correlationId  string	a correlation id.
+// Returns context.Context
+// a context with the correlation id.
+func AddCorrelationIdToContext(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, PrometheusCorrelationIdType, correlationId)
+}
+
+// GetCorrelationIdFromContext gets a correlation id from the context.
+//	Parameters:
+//		- ctx  context.Context	a context.
+// Returns string
+// the correlation id or empty string if it isn't set.
+func GetCorrelationIdFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	value, _ := ctx.Value(PrometheusCorrelationIdType).(string)
+	return value
+}
+
+// Creates an exemplar with trace_id and correlation_id labels taken from the context.
+// Labels that don't fit into the OpenMetrics length limit are skipped.
+// Returns nil if the context has no ids
+func newPrometheusExemplar(ctx context.Context, value float64) *PrometheusExemplar {
+	labels := make([]PrometheusLabel, 0, 2)
+	length := 0
+	add := func(name string, value string) {
+		size := utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+		if value != "" && length+size <= PrometheusExemplarMaxLength {
+			labels = append(labels, PrometheusLabel{Name: name, Value: value})
+			length += size
+		}
+	}
+	add("trace_id", GetTraceIdFromContext(ctx))
+	add("correlation_id", GetCorrelationIdFromContext(ctx))
+
+	if len(labels) == 0 {
+		return nil
+	}
+	return &PrometheusExemplar{
+		Labels:    labels,
+		Value:     value,
+		Timestamp: time.Now(),
+	}
+}
@@ -0,0 +1,113 @@
+package count
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PrometheusTextFormat is the classic Prometheus text exposition format 0.0.4.
+	PrometheusTextFormat = "text"
+	// PrometheusOpenMetricsFormat is the OpenMetrics 1.0 text exposition format.
+	PrometheusOpenMetricsFormat = "openmetrics"
+	// PrometheusProtobufFormat is the binary format of length-delimited io.prometheus.client.MetricFamily messages.
+	PrometheusProtobufFormat = "protobuf"
+	// PrometheusJsonFormat is a JSON list of metric families meant for debugging and dashboards rather than for scrapers.
+	PrometheusJsonFormat = "json"
+)
+
+const (
+	PrometheusTextContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	PrometheusOpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	PrometheusProtobufContentType    = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	PrometheusJsonContentType        = "application/json"
+)
+
+// PrometheusFormatContentType gets HTTP content type for the specified exposition format.
+//	Parameters:
+//		- format  an exposition format name.
+// Returns string
+// content type of the format or text format content type when the format is unknown.
+func PrometheusFormatContentType(format string) string {
+	switch format {
+	case PrometheusOpenMetricsFormat:
+		return PrometheusOpenMetricsContentType
+	case PrometheusProtobufFormat:
+		return PrometheusProtobufContentType
+	case PrometheusJsonFormat:
+		return PrometheusJsonContentType
+	default:
+		return PrometheusTextContentType
+	}
+}
+
+// NegotiatePrometheusFormat selects exposition format based on the value of HTTP Accept header.
+// Media ranges are ranked by their quality factor and the first supported one wins.
+// When nothing in the header is supported the classic text format is returned.
+//	Parameters:
+//		- accept  a value of Accept header sent by a scraper.
+// Returns string
+// the selected exposition format name.
+func NegotiatePrometheusFormat(accept string) string {
+	return NegotiatePrometheusFormatter(accept, DefaultPrometheusFormatters()).Format()
+}
+
+// NegotiatePrometheusFormatter selects a formatter based on the value of HTTP Accept header.
+// Media ranges are ranked by their quality factor and the first range accepted by any formatter wins.
+// When nothing in the header is supported the first formatter is returned.
+//	Parameters:
+//		- accept      a value of Accept header sent by a scraper.
+//		- formatters  formatters to select from, the first one is used by default.
+// Returns IPrometheusFormatter
+// the selected formatter or nil when there are no formatters.
+func NegotiatePrometheusFormatter(accept string, formatters []IPrometheusFormatter) IPrometheusFormatter {
+	type mediaRange struct {
+		formatter IPrometheusFormatter
+		quality   float64
+	}
+
+	ranges := make([]mediaRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		values := make(map[string]string)
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(kv[0]))
+			value := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+			if key == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+				continue
+			}
+			values[key] = value
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		for _, formatter := range formatters {
+			if formatter.Accepts(mediaType, values) {
+				ranges = append(ranges, mediaRange{formatter: formatter, quality: quality})
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].quality > ranges[j].quality
+	})
+	if len(ranges) > 0 {
+		return ranges[0].formatter
+	}
+	if len(formatters) > 0 {
+		return formatters[0]
+	}
+	return nil
+}
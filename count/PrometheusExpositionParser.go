@@ -0,0 +1,435 @@
+package count
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+)
+
+// ParsePrometheusExposition parses metrics in the classic Prometheus text format 0.0.4
+// or in the OpenMetrics 1.0 text format into metric families.
+// Families are returned in the order they appear in the exposition. Like families produced by
+// PrometheusCounterConverter, names of counter families don't include _total suffix
+// and labels of series are sorted by names. Samples without TYPE line are collected
+// into untyped families, sample timestamps are ignored.
+//	Parameters:
+//		- data  an exposition to parse.
+// Returns []*PrometheusMetricFamily, error
+// parsed metric families or error with the number of the invalid line.
+func ParsePrometheusExposition(data []byte) ([]*PrometheusMetricFamily, error) {
+	parser := newPrometheusExpositionParser()
+
+	lines := strings.Split(string(data), "\n")
+	for index, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "# EOF" {
+			break
+		}
+		if err := parser.parseLine(line); err != "" {
+			return nil, cerr.NewBadRequestError("", "INVALID_EXPOSITION", "Invalid Prometheus exposition: "+err).
+				WithDetails("line", index+1)
+		}
+	}
+	return parser.families, nil
+}
+
+// PrometheusFamiliesToCounters converts metric families into performance counters.
+// Counter families are converted into Increment counters, histograms and summaries
+// into Statistics counters with count and average, gauges and untyped families
+// into LastValue counters. Names of counters are made of family names and label values
+// sorted by label names separated by dots, i.e. http_requests.get.200.
+//	Parameters:
+//		- families  metric families to convert.
+// Returns []ccount.Counter
+// performance counters
+func PrometheusFamiliesToCounters(families []*PrometheusMetricFamily) []ccount.Counter {
+	counters := make([]ccount.Counter, 0, len(families))
+	for _, family := range families {
+		for _, metric := range family.Metrics {
+			name := family.Name
+			for _, label := range metric.Labels {
+				name += "." + label.Value
+			}
+
+			var counter ccount.Counter
+			switch family.Type {
+			case PrometheusTypeCounter:
+				counter = ccount.Counter{Name: name, Type: ccount.Increment}
+				counter.Count = int64(metric.Value)
+			case PrometheusTypeHistogram, PrometheusTypeSummary:
+				counter = ccount.Counter{Name: name, Type: ccount.Statistics}
+				counter.Count = int64(metric.Count)
+				if metric.Count > 0 {
+					counter.Average = metric.Sum / float64(metric.Count)
+				}
+			default:
+				counter = ccount.Counter{Name: name, Type: ccount.LastValue}
+				counter.Last = metric.Value
+			}
+			if !metric.Created.IsZero() {
+				counter.Time = metric.Created
+			}
+			counters = append(counters, counter)
+		}
+	}
+	return counters
+}
+
+// prometheusExpositionParser collects samples of exposition lines into metric families
+type prometheusExpositionParser struct {
+	families []*PrometheusMetricFamily
+	// Families by names used in metadata lines and samples
+	byName map[string]*PrometheusMetricFamily
+	// Metrics of families by family name and label signature
+	metrics map[string]*PrometheusMetric
+}
+
+func newPrometheusExpositionParser() *prometheusExpositionParser {
+	return &prometheusExpositionParser{
+		families: make([]*PrometheusMetricFamily, 0),
+		byName:   make(map[string]*PrometheusMetricFamily),
+		metrics:  make(map[string]*PrometheusMetric),
+	}
+}
+
+// Parses a single line and returns a description of the problem or an empty string
+func (c *prometheusExpositionParser) parseLine(line string) string {
+	if strings.TrimSpace(line) == "" {
+		return ""
+	}
+	if strings.HasPrefix(line, "#") {
+		return c.parseComment(line)
+	}
+	return c.parseSample(line)
+}
+
+// Parses HELP, TYPE and UNIT lines, other comments are ignored
+func (c *prometheusExpositionParser) parseComment(line string) string {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), " ", 3)
+	if len(fields) < 2 {
+		return ""
+	}
+
+	keyword, name, value := fields[0], fields[1], ""
+	if len(fields) > 2 {
+		value = fields[2]
+	}
+	switch keyword {
+	case "HELP":
+		if !PrometheusNameSanitizer.IsValidMetricName(name) {
+			return "invalid metric name " + strconv.Quote(name)
+		}
+		c.family(name).Help = unescapePrometheusString(value)
+	case "TYPE":
+		if !PrometheusNameSanitizer.IsValidMetricName(name) {
+			return "invalid metric name " + strconv.Quote(name)
+		}
+		typ, ok := parsePrometheusMetricType(strings.TrimSpace(value))
+		if !ok {
+			return "unsupported metric type " + strconv.Quote(value)
+		}
+		family := c.family(name)
+		if len(family.Metrics) > 0 {
+			return "TYPE line of " + name + " after its samples"
+		}
+		family.Type = typ
+		if typ == PrometheusTypeCounter && strings.HasSuffix(name, "_total") {
+			family.Name = strings.TrimSuffix(name, "_total")
+			c.byName[family.Name] = family
+		}
+	case "UNIT":
+		if !PrometheusNameSanitizer.IsValidMetricName(name) {
+			return "invalid metric name " + strconv.Quote(name)
+		}
+		c.family(name).Unit = strings.TrimSpace(value)
+	}
+	return ""
+}
+
+// Parses a sample line: name{labels} value [timestamp] [# {labels} value [timestamp]]
+func (c *prometheusExpositionParser) parseSample(line string) string {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return "sample without value"
+	}
+	name := line[:end]
+	if !PrometheusNameSanitizer.IsValidMetricName(name) {
+		return "invalid metric name " + strconv.Quote(name)
+	}
+
+	labels, rest, err := parsePrometheusLabels(line[end:])
+	if err != "" {
+		return err
+	}
+
+	var exemplar *PrometheusExemplar
+	if index := strings.Index(rest, " # "); index >= 0 {
+		if exemplar, err = parsePrometheusExemplar(rest[index+3:]); err != "" {
+			return err
+		}
+		rest = rest[:index]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "invalid value of " + name
+	}
+	value, parseErr := strconv.ParseFloat(fields[0], 64)
+	if parseErr != nil {
+		return "invalid value of " + name + ": " + strconv.Quote(fields[0])
+	}
+	if len(fields) > 1 {
+		if _, parseErr = strconv.ParseFloat(fields[1], 64); parseErr != nil {
+			return "invalid timestamp of " + name + ": " + strconv.Quote(fields[1])
+		}
+	}
+
+	family, suffix := c.lookup(name)
+	if family == nil {
+		return "unexpected sample " + name + " of " + c.byName[name].Name
+	}
+	return c.addSample(family, suffix, labels, value, exemplar)
+}
+
+// Finds a family of the sample and the suffix of the sample name.
+// Returns nil when the sample name is taken by a family that has no such samples.
+func (c *prometheusExpositionParser) lookup(name string) (*PrometheusMetricFamily, string) {
+	for _, suffix := range []string{"", "_total", "_created", "_bucket", "_sum", "_count"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family, ok := c.byName[strings.TrimSuffix(name, suffix)]
+		if ok && prometheusSuffixAllowed(family.Type, suffix) {
+			return family, suffix
+		}
+	}
+	if _, ok := c.byName[name]; ok {
+		return nil, ""
+	}
+	return c.family(name), ""
+}
+
+// Sets the value of the sample to a metric of the family
+func (c *prometheusExpositionParser) addSample(family *PrometheusMetricFamily, suffix string,
+	labels []PrometheusLabel, value float64, exemplar *PrometheusExemplar) string {
+	var bound, quantile string
+	seriesLabels := make([]PrometheusLabel, 0, len(labels))
+	for _, label := range labels {
+		switch {
+		case label.Name == "le" && family.Type == PrometheusTypeHistogram:
+			bound = label.Value
+		case label.Name == "quantile" && family.Type == PrometheusTypeSummary:
+			quantile = label.Value
+		default:
+			seriesLabels = append(seriesLabels, label)
+		}
+	}
+	sortPrometheusLabels(seriesLabels)
+	metric := c.metric(family, seriesLabels)
+
+	switch suffix {
+	case "_created":
+		metric.Created = time.Unix(0, int64(value*1e9))
+	case "_sum":
+		metric.Sum = value
+	case "_count":
+		metric.Count = uint64(value)
+	case "_bucket":
+		upperBound, err := strconv.ParseFloat(bound, 64)
+		if err != nil {
+			return "invalid le label of " + family.Name + ": " + strconv.Quote(bound)
+		}
+		if math.IsInf(upperBound, 1) {
+			metric.Count = uint64(value)
+			metric.Exemplar = exemplar
+		} else {
+			metric.Buckets = append(metric.Buckets, PrometheusBucket{
+				UpperBound:      upperBound,
+				CumulativeCount: uint64(value),
+				Exemplar:        exemplar,
+			})
+		}
+	default:
+		if family.Type == PrometheusTypeSummary {
+			q, err := strconv.ParseFloat(quantile, 64)
+			if err != nil {
+				return "invalid quantile label of " + family.Name + ": " + strconv.Quote(quantile)
+			}
+			metric.Quantiles = append(metric.Quantiles, PrometheusQuantile{Quantile: q, Value: value})
+		} else {
+			metric.Value = value
+			metric.Exemplar = exemplar
+		}
+	}
+	return ""
+}
+
+// Gets or creates an untyped family with specified name
+func (c *prometheusExpositionParser) family(name string) *PrometheusMetricFamily {
+	family, ok := c.byName[name]
+	if !ok {
+		family = NewPrometheusMetricFamily(name, PrometheusTypeUntyped)
+		c.byName[name] = family
+		c.families = append(c.families, family)
+	}
+	return family
+}
+
+// Gets or creates a metric of the family with specified sorted labels
+func (c *prometheusExpositionParser) metric(family *PrometheusMetricFamily, labels []PrometheusLabel) *PrometheusMetric {
+	key := family.Name + "\xff" + prometheusLabelsSignature(labels)
+	metric, ok := c.metrics[key]
+	if !ok {
+		metric = &PrometheusMetric{Labels: labels}
+		c.metrics[key] = metric
+		family.Metrics = append(family.Metrics, metric)
+	}
+	return metric
+}
+
+func parsePrometheusMetricType(value string) (PrometheusMetricType, bool) {
+	switch value {
+	case "counter":
+		return PrometheusTypeCounter, true
+	case "gauge":
+		return PrometheusTypeGauge, true
+	case "histogram":
+		return PrometheusTypeHistogram, true
+	case "summary":
+		return PrometheusTypeSummary, true
+	case "untyped", "unknown":
+		return PrometheusTypeUntyped, true
+	}
+	return "", false
+}
+
+func prometheusSuffixAllowed(typ PrometheusMetricType, suffix string) bool {
+	switch typ {
+	case PrometheusTypeCounter:
+		return suffix == "" || suffix == "_total" || suffix == "_created"
+	case PrometheusTypeHistogram:
+		return suffix == "_bucket" || suffix == "_sum" || suffix == "_count" || suffix == "_created"
+	case PrometheusTypeSummary:
+		return suffix == "" || suffix == "_sum" || suffix == "_count" || suffix == "_created"
+	}
+	return suffix == ""
+}
+
+// Parses optional labels in curly braces and returns them with the rest of the line
+func parsePrometheusLabels(text string) ([]PrometheusLabel, string, string) {
+	labels := make([]PrometheusLabel, 0)
+	if !strings.HasPrefix(text, "{") {
+		return labels, text, ""
+	}
+
+	text = text[1:]
+	for {
+		text = strings.TrimLeft(text, " ")
+		if strings.HasPrefix(text, "}") {
+			return labels, text[1:], ""
+		}
+
+		index := strings.Index(text, `="`)
+		if index < 0 {
+			return nil, "", "invalid labels"
+		}
+		name := strings.TrimSpace(text[:index])
+		if !PrometheusNameSanitizer.IsValidLabelName(name) {
+			return nil, "", "invalid label name " + strconv.Quote(name)
+		}
+
+		value, rest, ok := readPrometheusQuoted(text[index+2:])
+		if !ok {
+			return nil, "", "unterminated value of label " + name
+		}
+		labels = append(labels, PrometheusLabel{Name: name, Value: value})
+
+		text = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(text, ",") {
+			text = text[1:]
+		} else if !strings.HasPrefix(text, "}") {
+			return nil, "", "invalid labels"
+		}
+	}
+}
+
+// Parses an OpenMetrics exemplar: {labels} value [timestamp]
+func parsePrometheusExemplar(text string) (*PrometheusExemplar, string) {
+	labels, rest, err := parsePrometheusLabels(strings.TrimSpace(text))
+	if err != "" {
+		return nil, "exemplar with " + err
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, "invalid exemplar value"
+	}
+	exemplar := &PrometheusExemplar{Labels: labels}
+	value, parseErr := strconv.ParseFloat(fields[0], 64)
+	if parseErr != nil {
+		return nil, "invalid exemplar value " + strconv.Quote(fields[0])
+	}
+	exemplar.Value = value
+	if len(fields) > 1 {
+		timestamp, parseErr := strconv.ParseFloat(fields[1], 64)
+		if parseErr != nil {
+			return nil, "invalid exemplar timestamp " + strconv.Quote(fields[1])
+		}
+		exemplar.Timestamp = time.Unix(0, int64(timestamp*1e9))
+	}
+	return exemplar, ""
+}
+
+// Reads an escaped string terminated by a double quote and returns it with the rest of the text
+func readPrometheusQuoted(text string) (string, string, bool) {
+	builder := strings.Builder{}
+	for index := 0; index < len(text); index++ {
+		switch text[index] {
+		case '"':
+			return builder.String(), text[index+1:], true
+		case '\\':
+			index++
+			if index == len(text) {
+				return "", "", false
+			}
+			writePrometheusUnescaped(&builder, text[index])
+		default:
+			builder.WriteByte(text[index])
+		}
+	}
+	return "", "", false
+}
+
+// Unescapes HELP text of text and OpenMetrics formats
+func unescapePrometheusString(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+
+	builder := strings.Builder{}
+	for index := 0; index < len(text); index++ {
+		if text[index] == '\\' && index+1 < len(text) {
+			index++
+			writePrometheusUnescaped(&builder, text[index])
+		} else {
+			builder.WriteByte(text[index])
+		}
+	}
+	return builder.String()
+}
+
+func writePrometheusUnescaped(builder *strings.Builder, escaped byte) {
+	switch escaped {
+	case 'n':
+		builder.WriteByte('\n')
+	case '\\', '"':
+		builder.WriteByte(escaped)
+	default:
+		builder.WriteByte('\\')
+		builder.WriteByte(escaped)
+	}
+}
@@ -0,0 +1,588 @@
+package count
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError describes a problem found in a Prometheus exposition by Validate.
+type ValidationError struct {
+	// Line is the number of the line with the problem starting from 1, or 0 for problems of the whole exposition.
+	Line int `json:"line"`
+	// Message is a description of the problem.
+	Message string `json:"message"`
+}
+
+// Error gets a description of the problem with the number of the line.
+// Returns string
+// the description of the problem
+func (c ValidationError) Error() string {
+	if c.Line == 0 {
+		return c.Message
+	}
+	return "line " + strconv.Itoa(c.Line) + ": " + c.Message
+}
+
+// Validate checks an exposition against the grammar of the classic Prometheus text format 0.0.4
+// or the OpenMetrics 1.0 text format. Expositions terminated with # EOF line are checked as OpenMetrics,
+// other expositions are checked as the classic text format.
+// Unlike ParsePrometheusExposition it doesn't stop at the first problem and reports all of them.
+//	Parameters:
+//		- exposition  an exposition to check.
+// Returns []ValidationError
+// problems found in the exposition or empty list if it is valid.
+func Validate(exposition []byte) []ValidationError {
+	format := PrometheusTextFormat
+	for _, line := range strings.Split(string(exposition), "\n") {
+		if line == "# EOF" {
+			format = PrometheusOpenMetricsFormat
+			break
+		}
+	}
+	return ValidateFormat(format, exposition)
+}
+
+// ValidateFormat checks an exposition against the grammar of the specified format.
+// It checks names of metrics and labels, escaping of label values and HELP text,
+// placement of TYPE, HELP and UNIT lines, grouping of families, suffixes of samples,
+// duplicated series, values, timestamps, exemplars and # EOF line of OpenMetrics.
+//	Parameters:
+//		- format      PrometheusTextFormat or PrometheusOpenMetricsFormat.
+//		- exposition  an exposition to check.
+// Returns []ValidationError
+// problems found in the exposition or empty list if it is valid.
+func ValidateFormat(format string, exposition []byte) []ValidationError {
+	validator := newPrometheusExpositionValidator(format == PrometheusOpenMetricsFormat)
+
+	text := string(exposition)
+	if text != "" && !strings.HasSuffix(text, "\n") && !(validator.openMetrics && strings.HasSuffix(text, "# EOF")) {
+		validator.errors = append(validator.errors, ValidationError{Message: "last line is not terminated by a line feed"})
+	}
+
+	lines := make([]string, 0)
+	if text != "" {
+		lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	}
+	eof := 0
+	for index, line := range lines {
+		validator.line = index + 1
+		if eof > 0 {
+			validator.report("line after # EOF")
+			break
+		}
+		if validator.openMetrics && line == "# EOF" {
+			eof = validator.line
+			continue
+		}
+		validator.validateLine(line)
+	}
+
+	validator.line = 0
+	if validator.openMetrics && eof == 0 {
+		validator.report("missing # EOF line")
+	}
+	validator.validateHistograms()
+	return validator.errors
+}
+
+// prometheusValidatedFamily keeps what is known about a family while the exposition is checked
+type prometheusValidatedFamily struct {
+	name  string
+	typ   string
+	help  bool
+	typed bool
+	unit  bool
+	// samples is true when samples of the family were seen
+	samples bool
+	// closed is true when lines of another family follow lines of this one
+	closed bool
+	// interleaved is true when the problem of interleaved lines is already reported
+	interleaved bool
+}
+
+// prometheusValidatedHistogram keeps the first line of a histogram series and if its +Inf bucket was seen
+type prometheusValidatedHistogram struct {
+	name string
+	line int
+	inf  bool
+}
+
+// prometheusExpositionValidator collects problems of exposition lines
+type prometheusExpositionValidator struct {
+	openMetrics bool
+	line        int
+	errors      []ValidationError
+	families    map[string]*prometheusValidatedFamily
+	current     *prometheusValidatedFamily
+	// Lines of samples by sample names and label signatures
+	series map[string]int
+	// Histogram series by family names and label signatures without le label
+	histograms     map[string]*prometheusValidatedHistogram
+	histogramOrder []string
+}
+
+func newPrometheusExpositionValidator(openMetrics bool) *prometheusExpositionValidator {
+	return &prometheusExpositionValidator{
+		openMetrics: openMetrics,
+		errors:      make([]ValidationError, 0),
+		families:    make(map[string]*prometheusValidatedFamily),
+		series:      make(map[string]int),
+		histograms:  make(map[string]*prometheusValidatedHistogram),
+	}
+}
+
+func (c *prometheusExpositionValidator) report(message string) {
+	c.errors = append(c.errors, ValidationError{Line: c.line, Message: message})
+}
+
+func (c *prometheusExpositionValidator) validateLine(line string) {
+	if !utf8.ValidString(line) {
+		c.report("invalid UTF-8 sequence")
+		return
+	}
+	if strings.HasSuffix(line, "\r") {
+		c.report("line is terminated by a carriage return")
+		return
+	}
+	if strings.TrimSpace(line) == "" {
+		if c.openMetrics {
+			c.report("empty line")
+		}
+		return
+	}
+	if strings.HasPrefix(line, "#") {
+		c.validateComment(line)
+		return
+	}
+	c.validateSample(line)
+}
+
+// Checks HELP, TYPE and UNIT lines. Other comments are allowed only in the text format.
+func (c *prometheusExpositionValidator) validateComment(line string) {
+	fields := strings.SplitN(line, " ", 4)
+	keyword := ""
+	if len(fields) > 1 && fields[0] == "#" {
+		keyword = fields[1]
+	}
+	if keyword != "HELP" && keyword != "TYPE" && (keyword != "UNIT" || !c.openMetrics) {
+		if c.openMetrics {
+			c.report("unexpected comment, only HELP, TYPE, UNIT and EOF lines are allowed")
+		}
+		return
+	}
+	if len(fields) < 3 {
+		c.report(keyword + " line without metric name")
+		return
+	}
+
+	name, value := fields[2], ""
+	if len(fields) > 3 {
+		value = fields[3]
+	}
+	if !PrometheusNameSanitizer.IsValidMetricName(name) {
+		c.report("invalid metric name " + strconv.Quote(name))
+		return
+	}
+
+	family := c.family(name)
+	switch keyword {
+	case "HELP":
+		if family.help {
+			c.report("duplicate HELP line of " + name)
+		} else if c.openMetrics && family.samples {
+			c.report("HELP line of " + name + " after its samples")
+		}
+		family.help = true
+		if problem := c.checkEscapes(value, !c.openMetrics); problem != "" {
+			c.report(problem + " in HELP of " + name)
+		}
+	case "TYPE":
+		if family.typed {
+			c.report("duplicate TYPE line of " + name)
+			return
+		}
+		if family.samples {
+			c.report("TYPE line of " + name + " after its samples")
+		}
+		family.typed = true
+		if !c.isValidType(value) {
+			c.report("unsupported metric type " + strconv.Quote(value))
+			return
+		}
+		family.typ = value
+	case "UNIT":
+		if family.unit {
+			c.report("duplicate UNIT line of " + name)
+		} else if family.samples {
+			c.report("UNIT line of " + name + " after its samples")
+		}
+		family.unit = true
+		if value != "" && !strings.HasSuffix(name, "_"+value) {
+			c.report("name of " + name + " doesn't end with unit " + value)
+		}
+	}
+}
+
+// Checks a sample line: name{labels} value [timestamp] [# {labels} value [timestamp]]
+func (c *prometheusExpositionValidator) validateSample(line string) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		c.report("sample without value")
+		return
+	}
+	name := line[:end]
+	if !PrometheusNameSanitizer.IsValidMetricName(name) {
+		c.report("invalid metric name " + strconv.Quote(name))
+		return
+	}
+
+	labels, rest, ok := c.readLabels(line[end:], false)
+	if !ok {
+		return
+	}
+
+	exemplar := ""
+	if index := strings.Index(rest, " # "); index >= 0 {
+		exemplar = rest[index+3:]
+		rest = rest[:index]
+	}
+
+	fields := strings.Split(strings.TrimPrefix(rest, " "), " ")
+	if !c.openMetrics {
+		fields = strings.Fields(rest)
+	}
+	if len(fields) == 0 || fields[0] == "" || len(fields) > 2 {
+		c.report("invalid value of " + name)
+		return
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		c.report("invalid value of " + name + ": " + strconv.Quote(fields[0]))
+		return
+	}
+	if len(fields) > 1 && !c.isValidTimestamp(fields[1]) {
+		c.report("invalid timestamp of " + name + ": " + strconv.Quote(fields[1]))
+	}
+
+	family, suffix := c.lookup(name)
+	if family == nil {
+		return
+	}
+	c.enter(family)
+	family.samples = true
+
+	c.validateSampleLabels(family, name, suffix, labels, value)
+	if exemplar != "" {
+		c.validateExemplar(family, name, suffix, exemplar)
+	}
+
+	sortPrometheusLabels(labels)
+	key := name + "\xff" + prometheusLabelsSignature(labels)
+	if first, ok := c.series[key]; ok {
+		c.report("duplicate sample " + name + " of series reported at line " + strconv.Itoa(first))
+	} else {
+		c.series[key] = c.line
+	}
+}
+
+// Checks labels and values of samples that have special meaning in histograms, summaries and counters
+func (c *prometheusExpositionValidator) validateSampleLabels(family *prometheusValidatedFamily, name string,
+	suffix string, labels []PrometheusLabel, value float64) {
+	switch {
+	case suffix == "_bucket":
+		bound, ok := findPrometheusLabel(labels, "le")
+		if !ok {
+			c.report("bucket " + name + " without le label")
+			return
+		}
+		upperBound, err := strconv.ParseFloat(bound, 64)
+		if err != nil {
+			c.report("invalid le label of " + name + ": " + strconv.Quote(bound))
+			return
+		}
+
+		seriesLabels := make([]PrometheusLabel, 0, len(labels))
+		for _, label := range labels {
+			if label.Name != "le" {
+				seriesLabels = append(seriesLabels, label)
+			}
+		}
+		sortPrometheusLabels(seriesLabels)
+		key := family.name + "\xff" + prometheusLabelsSignature(seriesLabels)
+		histogram, ok := c.histograms[key]
+		if !ok {
+			histogram = &prometheusValidatedHistogram{name: family.name, line: c.line}
+			c.histograms[key] = histogram
+			c.histogramOrder = append(c.histogramOrder, key)
+		}
+		histogram.inf = histogram.inf || math.IsInf(upperBound, 1)
+	case suffix == "" && family.typ == "summary":
+		quantile, ok := findPrometheusLabel(labels, "quantile")
+		if !ok {
+			c.report("summary " + name + " without quantile label")
+			return
+		}
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil || q < 0 || q > 1 {
+			c.report("invalid quantile label of " + name + ": " + strconv.Quote(quantile))
+		}
+	}
+
+	negative := value < 0
+	switch {
+	case family.typ == "counter" && (suffix == "" || suffix == "_total") && negative:
+		c.report("negative value of counter " + name)
+	case (suffix == "_bucket" || suffix == "_count" || suffix == "_gcount") && negative:
+		c.report("negative value of " + name)
+	}
+}
+
+// Checks an exemplar which is allowed in OpenMetrics for counters and histogram buckets
+func (c *prometheusExpositionValidator) validateExemplar(family *prometheusValidatedFamily, name string,
+	suffix string, exemplar string) {
+	if !c.openMetrics {
+		c.report("exemplars are not supported in the text format")
+		return
+	}
+	if suffix != "_total" && suffix != "_bucket" {
+		c.report("exemplar of " + name + " which is not a counter or a histogram bucket")
+	}
+
+	labels, rest, ok := c.readLabels(exemplar, true)
+	if !ok {
+		return
+	}
+	length := 0
+	for _, label := range labels {
+		length += utf8.RuneCountInString(label.Name) + utf8.RuneCountInString(label.Value)
+	}
+	if length > 128 {
+		c.report("labels of exemplar of " + name + " are longer than 128 characters")
+	}
+
+	fields := strings.Split(strings.TrimPrefix(rest, " "), " ")
+	if len(fields) == 0 || len(fields) > 2 {
+		c.report("invalid exemplar value of " + name)
+		return
+	}
+	if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+		c.report("invalid exemplar value of " + name + ": " + strconv.Quote(fields[0]))
+	}
+	if len(fields) > 1 && !c.isValidTimestamp(fields[1]) {
+		c.report("invalid exemplar timestamp of " + name + ": " + strconv.Quote(fields[1]))
+	}
+}
+
+// Reports histogram series without +Inf bucket
+func (c *prometheusExpositionValidator) validateHistograms() {
+	for _, key := range c.histogramOrder {
+		histogram := c.histograms[key]
+		if !histogram.inf {
+			c.line = histogram.line
+			c.report("histogram " + histogram.name + " without +Inf bucket")
+		}
+	}
+	c.line = 0
+}
+
+// Reads labels in curly braces and returns them with the rest of the line.
+// Problems are reported and false is returned when labels are invalid.
+func (c *prometheusExpositionValidator) readLabels(text string, exemplar bool) ([]PrometheusLabel, string, bool) {
+	labels := make([]PrometheusLabel, 0)
+	if !strings.HasPrefix(text, "{") {
+		if exemplar {
+			c.report("exemplar without labels")
+			return nil, "", false
+		}
+		return labels, text, true
+	}
+
+	names := make(map[string]bool)
+	text = text[1:]
+	for {
+		text = strings.TrimLeft(text, " ")
+		if strings.HasPrefix(text, "}") {
+			return labels, text[1:], true
+		}
+
+		index := strings.Index(text, `="`)
+		if index < 0 {
+			c.report("invalid labels")
+			return nil, "", false
+		}
+		name := strings.TrimSpace(text[:index])
+		switch {
+		case !PrometheusNameSanitizer.IsValidLabelName(name):
+			c.report("invalid label name " + strconv.Quote(name))
+			return nil, "", false
+		case strings.HasPrefix(name, "__"):
+			c.report("label name " + name + " is reserved for internal use")
+		case names[name]:
+			c.report("duplicate label " + name)
+		}
+		names[name] = true
+
+		value, rest, problem := readValidatedPrometheusQuoted(text[index+2:])
+		if problem != "" {
+			c.report(problem + " in value of label " + name)
+			return nil, "", false
+		}
+		labels = append(labels, PrometheusLabel{Name: name, Value: value})
+
+		text = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(text, ",") {
+			text = text[1:]
+		} else if !strings.HasPrefix(text, "}") {
+			c.report("invalid labels")
+			return nil, "", false
+		}
+	}
+}
+
+// Finds a family of the sample. Returns nil when the sample name is taken
+// by a family that has no such samples, the problem is reported.
+func (c *prometheusExpositionValidator) lookup(name string) (*prometheusValidatedFamily, string) {
+	for _, suffix := range []string{"", "_total", "_created", "_bucket", "_sum", "_count", "_gsum", "_gcount", "_info"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family, ok := c.families[strings.TrimSuffix(name, suffix)]
+		if ok && c.suffixAllowed(family.typ, suffix) {
+			return family, suffix
+		}
+	}
+	if family, ok := c.families[name]; ok {
+		c.report("sample " + name + " doesn't have a suffix of " + family.typ + " " + name)
+		return nil, ""
+	}
+	return c.family(name), ""
+}
+
+// Gets or creates a family and makes it current
+func (c *prometheusExpositionValidator) family(name string) *prometheusValidatedFamily {
+	family, ok := c.families[name]
+	if !ok {
+		family = &prometheusValidatedFamily{name: name, typ: "untyped"}
+		if c.openMetrics {
+			family.typ = "unknown"
+		}
+		c.families[name] = family
+	}
+	c.enter(family)
+	return family
+}
+
+// Makes the family current and reports families which lines are not grouped together
+func (c *prometheusExpositionValidator) enter(family *prometheusValidatedFamily) {
+	if c.current == family {
+		return
+	}
+	if c.current != nil {
+		c.current.closed = true
+	}
+	if family.closed && !family.interleaved {
+		c.report("lines of family " + family.name + " are interleaved with other families")
+		family.interleaved = true
+	}
+	c.current = family
+}
+
+func (c *prometheusExpositionValidator) isValidType(typ string) bool {
+	switch typ {
+	case "counter", "gauge", "histogram", "summary":
+		return true
+	case "untyped":
+		return !c.openMetrics
+	case "unknown", "gaugehistogram", "stateset", "info":
+		return c.openMetrics
+	}
+	return false
+}
+
+// Checks a timestamp which is an integer number of milliseconds in the text format
+// and a number of seconds in OpenMetrics
+func (c *prometheusExpositionValidator) isValidTimestamp(timestamp string) bool {
+	if c.openMetrics {
+		_, err := strconv.ParseFloat(timestamp, 64)
+		return err == nil
+	}
+	_, err := strconv.ParseInt(timestamp, 10, 64)
+	return err == nil
+}
+
+func (c *prometheusExpositionValidator) suffixAllowed(typ string, suffix string) bool {
+	if !c.openMetrics {
+		switch typ {
+		case "histogram":
+			return suffix == "_bucket" || suffix == "_sum" || suffix == "_count"
+		case "summary":
+			return suffix == "" || suffix == "_sum" || suffix == "_count"
+		}
+		return suffix == ""
+	}
+
+	switch typ {
+	case "counter":
+		return suffix == "_total" || suffix == "_created"
+	case "histogram":
+		return suffix == "_bucket" || suffix == "_sum" || suffix == "_count" || suffix == "_created"
+	case "gaugehistogram":
+		return suffix == "_bucket" || suffix == "_gsum" || suffix == "_gcount"
+	case "summary":
+		return suffix == "" || suffix == "_sum" || suffix == "_count" || suffix == "_created"
+	case "info":
+		return suffix == "_info"
+	}
+	return suffix == ""
+}
+
+// Checks escape sequences of HELP text. Double quotes are escaped only in OpenMetrics.
+func (c *prometheusExpositionValidator) checkEscapes(text string, classic bool) string {
+	for index := 0; index < len(text); index++ {
+		if text[index] != '\\' {
+			continue
+		}
+		index++
+		if index == len(text) {
+			return "unterminated escape sequence"
+		}
+		if text[index] != '\\' && text[index] != 'n' && (classic || text[index] != '"') {
+			return "invalid escape sequence \\" + string(text[index])
+		}
+	}
+	return ""
+}
+
+// Reads a label value terminated by a double quote checking its escape sequences
+func readValidatedPrometheusQuoted(text string) (string, string, string) {
+	builder := strings.Builder{}
+	for index := 0; index < len(text); index++ {
+		switch text[index] {
+		case '"':
+			return builder.String(), text[index+1:], ""
+		case '\\':
+			index++
+			if index == len(text) {
+				return "", "", "unterminated escape sequence"
+			}
+			if text[index] != '\\' && text[index] != 'n' && text[index] != '"' {
+				return "", "", "invalid escape sequence \\" + string(text[index])
+			}
+			writePrometheusUnescaped(&builder, text[index])
+		default:
+			builder.WriteByte(text[index])
+		}
+	}
+	return "", "", "unterminated string"
+}
+
+func findPrometheusLabel(labels []PrometheusLabel, name string) (string, bool) {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value, true
+		}
+	}
+	return "", false
+}
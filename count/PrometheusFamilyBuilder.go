@@ -0,0 +1,183 @@
+package count
+
+import (
+	"sort"
+	"strings"
+)
+
+// prometheusSample is a single value produced from a counter before it is placed into a family.
+type prometheusSample struct {
+	family string
+	typ    PrometheusMetricType
+	metric *PrometheusMetric
+	help   string
+	unit   string
+}
+
+// prometheusCollision describes a counter that was dropped
+// because its samples clash with samples of another counter.
+type prometheusCollision struct {
+	counter string
+	other   string
+	family  string
+}
+
+// prometheusFamilyBuilder groups samples into metric families.
+// All samples of a counter are added at once and when any of them clashes
+// with already added samples the whole counter is rejected, so the output stays valid.
+type prometheusFamilyBuilder struct {
+	families   map[string]*PrometheusMetricFamily
+	owners     map[string]string
+	series     map[string]string
+	names      map[string]string
+	signatures map[*PrometheusMetric]string
+	collisions []prometheusCollision
+}
+
+func newPrometheusFamilyBuilder() *prometheusFamilyBuilder {
+	return &prometheusFamilyBuilder{
+		families:   make(map[string]*PrometheusMetricFamily),
+		owners:     make(map[string]string),
+		series:     make(map[string]string),
+		names:      make(map[string]string),
+		signatures: make(map[*PrometheusMetric]string),
+		collisions: make([]prometheusCollision, 0),
+	}
+}
+
+// Adds all samples produced by a counter
+//	Parameters:
+//		- counter  a name of the counter that produced the samples
+//		- samples  samples to add
+// Returns true if samples were added or false if they collide with other counters
+func (c *prometheusFamilyBuilder) add(counter string, samples ...prometheusSample) bool {
+	keys := make([]string, len(samples))
+	signatures := make([]string, len(samples))
+	names := make(map[string]string)
+	for index, sample := range samples {
+		sortPrometheusLabels(sample.metric.Labels)
+		signatures[index] = prometheusLabelsSignature(sample.metric.Labels)
+
+		if family, ok := c.families[sample.family]; ok && family.Type != sample.typ {
+			c.collisions = append(c.collisions, prometheusCollision{counter: counter, other: c.owners[sample.family], family: sample.family})
+			return false
+		}
+
+		// A new family must not emit sample names used by other families
+		if _, ok := c.families[sample.family]; !ok {
+			for _, name := range prometheusSampleNames(sample.family, sample.typ) {
+				if family, ok := c.names[name]; ok && family != sample.family {
+					c.collisions = append(c.collisions, prometheusCollision{counter: counter, other: c.owners[family], family: sample.family})
+					return false
+				}
+				if family, ok := names[name]; ok && family != sample.family {
+					c.collisions = append(c.collisions, prometheusCollision{counter: counter, other: counter, family: sample.family})
+					return false
+				}
+				names[name] = sample.family
+			}
+		}
+
+		keys[index] = sample.family + signatures[index]
+		if other, ok := c.series[keys[index]]; ok {
+			c.collisions = append(c.collisions, prometheusCollision{counter: counter, other: other, family: sample.family})
+			return false
+		}
+		for _, key := range keys[:index] {
+			if key == keys[index] {
+				c.collisions = append(c.collisions, prometheusCollision{counter: counter, other: counter, family: sample.family})
+				return false
+			}
+		}
+	}
+
+	for index, sample := range samples {
+		family, ok := c.families[sample.family]
+		if !ok {
+			family = NewPrometheusMetricFamily(sample.family, sample.typ)
+			c.families[sample.family] = family
+			c.owners[sample.family] = counter
+			for _, name := range prometheusSampleNames(sample.family, sample.typ) {
+				c.names[name] = sample.family
+			}
+		}
+		// The first counter with metadata describes the family
+		if family.Help == "" && family.Unit == "" {
+			family.Help = sample.help
+			family.Unit = sample.unit
+		}
+		family.Metrics = append(family.Metrics, sample.metric)
+		c.series[keys[index]] = counter
+		c.signatures[sample.metric] = signatures[index]
+	}
+	return true
+}
+
+// Gets collected families sorted by name with series sorted by their labels
+func (c *prometheusFamilyBuilder) build() []*PrometheusMetricFamily {
+	families := make([]*PrometheusMetricFamily, 0, len(c.families))
+	for _, family := range c.families {
+		// Signatures are computed once per series, not on each comparison
+		signatures := make([]string, len(family.Metrics))
+		for index, metric := range family.Metrics {
+			signatures[index] = c.signatures[metric]
+		}
+		sort.Stable(prometheusMetricsBySignature{metrics: family.Metrics, signatures: signatures})
+		families = append(families, family)
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// Gets names of all samples a family can emit in text and OpenMetrics formats
+func prometheusSampleNames(family string, typ PrometheusMetricType) []string {
+	switch typ {
+	case PrometheusTypeCounter:
+		return []string{family, family + "_total", family + "_created"}
+	case PrometheusTypeHistogram:
+		return []string{family, family + "_bucket", family + "_sum", family + "_count", family + "_created"}
+	case PrometheusTypeSummary:
+		return []string{family, family + "_sum", family + "_count", family + "_created"}
+	default:
+		return []string{family}
+	}
+}
+
+func sortPrometheusLabels(labels []PrometheusLabel) {
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+}
+
+func prometheusLabelsSignature(labels []PrometheusLabel) string {
+	builder := strings.Builder{}
+	for _, label := range labels {
+		builder.WriteString(label.Name)
+		builder.WriteByte(0xff)
+		builder.WriteString(label.Value)
+		builder.WriteByte(0xff)
+	}
+	return builder.String()
+}
+
+// prometheusMetricsBySignature sorts metrics of a family by precomputed label signatures
+type prometheusMetricsBySignature struct {
+	metrics    []*PrometheusMetric
+	signatures []string
+}
+
+func (c prometheusMetricsBySignature) Len() int {
+	return len(c.metrics)
+}
+
+func (c prometheusMetricsBySignature) Less(i, j int) bool {
+	return c.signatures[i] < c.signatures[j]
+}
+
+func (c prometheusMetricsBySignature) Swap(i, j int) {
+	c.metrics[i], c.metrics[j] = c.metrics[j], c.metrics[i]
+	c.signatures[i], c.signatures[j] = c.signatures[j], c.signatures[i]
+}
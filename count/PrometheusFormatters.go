@@ -0,0 +1,229 @@
+package count
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+)
+
+// PrometheusTextFormatter writes metric families in the classic Prometheus text exposition format 0.0.4.
+type PrometheusTextFormatter struct{}
+
+// NewPrometheusTextFormatter creates a new instance of the formatter.
+// Returns *PrometheusTextFormatter
+// pointer on new instance
+func NewPrometheusTextFormatter() *PrometheusTextFormatter {
+	return &PrometheusTextFormatter{}
+}
+
+// Format gets a name of the exposition format.
+// Returns PrometheusTextFormat
+func (c *PrometheusTextFormatter) Format() string {
+	return PrometheusTextFormat
+}
+
+// ContentType gets HTTP content type of the output.
+// Returns PrometheusTextContentType
+func (c *PrometheusTextFormatter) ContentType() string {
+	return PrometheusTextContentType
+}
+
+// Accepts checks if the formatter can produce output for a media range from HTTP Accept header.
+//	Parameters:
+//		- mediaType  a lowercase media type.
+//		- params     media type parameters.
+// Returns true for text/plain with version 0.0.4 and wildcards
+func (c *PrometheusTextFormatter) Accepts(mediaType string, params map[string]string) bool {
+	switch mediaType {
+	case "text/plain", "text/*", "*/*":
+		version := params["version"]
+		return version == "" || version == "0.0.4"
+	}
+	return false
+}
+
+// Write streams metric families in the text format through a pooled buffer.
+//	Parameters:
+//		- writer    a writer to write output to.
+//		- families  metric families to write.
+// Returns error or nil, if no errors occured.
+func (c *PrometheusTextFormatter) Write(writer io.Writer, families []*PrometheusMetricFamily) error {
+	textWriter := acquirePrometheusTextWriter(writer)
+	writeTextFamilies(textWriter, families)
+	return releasePrometheusTextWriter(textWriter)
+}
+
+// PrometheusOpenMetricsFormatter writes metric families in the OpenMetrics 1.0 text exposition format.
+type PrometheusOpenMetricsFormatter struct{}
+
+// NewPrometheusOpenMetricsFormatter creates a new instance of the formatter.
+// Returns *PrometheusOpenMetricsFormatter
+// pointer on new instance
+func NewPrometheusOpenMetricsFormatter() *PrometheusOpenMetricsFormatter {
+	return &PrometheusOpenMetricsFormatter{}
+}
+
+// Format gets a name of the exposition format.
+// Returns PrometheusOpenMetricsFormat
+func (c *PrometheusOpenMetricsFormatter) Format() string {
+	return PrometheusOpenMetricsFormat
+}
+
+// ContentType gets HTTP content type of the output.
+// Returns PrometheusOpenMetricsContentType
+func (c *PrometheusOpenMetricsFormatter) ContentType() string {
+	return PrometheusOpenMetricsContentType
+}
+
+// Accepts checks if the formatter can produce output for a media range from HTTP Accept header.
+//	Parameters:
+//		- mediaType  a lowercase media type.
+//		- params     media type parameters.
+// Returns true for application/openmetrics-text with version 1.0.0
+func (c *PrometheusOpenMetricsFormatter) Accepts(mediaType string, params map[string]string) bool {
+	version := params["version"]
+	return mediaType == "application/openmetrics-text" && (version == "" || version == "1.0.0")
+}
+
+// Write streams metric families in the OpenMetrics format terminated by # EOF line through a pooled buffer.
+//	Parameters:
+//		- writer    a writer to write output to.
+//		- families  metric families to write.
+// Returns error or nil, if no errors occured.
+func (c *PrometheusOpenMetricsFormatter) Write(writer io.Writer, families []*PrometheusMetricFamily) error {
+	textWriter := acquirePrometheusTextWriter(writer)
+	writeOpenMetricsFamilies(textWriter, families)
+	return releasePrometheusTextWriter(textWriter)
+}
+
+// PrometheusProtobufFormatter writes metric families as length-delimited io.prometheus.client.MetricFamily messages.
+type PrometheusProtobufFormatter struct{}
+
+// NewPrometheusProtobufFormatter creates a new instance of the formatter.
+// Returns *PrometheusProtobufFormatter
+// pointer on new instance
+func NewPrometheusProtobufFormatter() *PrometheusProtobufFormatter {
+	return &PrometheusProtobufFormatter{}
+}
+
+// Format gets a name of the exposition format.
+// Returns PrometheusProtobufFormat
+func (c *PrometheusProtobufFormatter) Format() string {
+	return PrometheusProtobufFormat
+}
+
+// ContentType gets HTTP content type of the output.
+// Returns PrometheusProtobufContentType
+func (c *PrometheusProtobufFormatter) ContentType() string {
+	return PrometheusProtobufContentType
+}
+
+// Accepts checks if the formatter can produce output for a media range from HTTP Accept header.
+//	Parameters:
+//		- mediaType  a lowercase media type.
+//		- params     media type parameters.
+// Returns true for application/vnd.google.protobuf with MetricFamily proto and delimited encoding
+func (c *PrometheusProtobufFormatter) Accepts(mediaType string, params map[string]string) bool {
+	return mediaType == "application/vnd.google.protobuf" &&
+		params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited"
+}
+
+// Write streams metric families in the protobuf format. Each family is encoded into a pooled buffer
+// and written as soon as it is ready.
+//	Parameters:
+//		- writer    a writer to write output to.
+//		- families  metric families to write.
+// Returns error or nil, if no errors occured.
+func (c *PrometheusProtobufFormatter) Write(writer io.Writer, families []*PrometheusMetricFamily) error {
+	buffer := prometheusProtobufBufferPool.Get().(*[]byte)
+	defer prometheusProtobufBufferPool.Put(buffer)
+
+	for _, family := range families {
+		*buffer = writeProtobufFamilies((*buffer)[:0], []*PrometheusMetricFamily{family})
+		if _, err := writer.Write(*buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var prometheusProtobufBufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 0, 4096)
+		return &buffer
+	},
+}
+
+// PrometheusJsonFormatter writes metric families or counters as a JSON list.
+// NaN and infinite values can't be represented by JSON numbers, so they are written as "NaN", "+Inf" and "-Inf" strings.
+// JSON is meant for debugging and other consumers than Prometheus, so it can't be used to push metrics.
+type PrometheusJsonFormatter struct{}
+
+// NewPrometheusJsonFormatter creates a new instance of the formatter.
+// Returns *PrometheusJsonFormatter
+// pointer on new instance
+func NewPrometheusJsonFormatter() *PrometheusJsonFormatter {
+	return &PrometheusJsonFormatter{}
+}
+
+// Format gets a name of the exposition format.
+// Returns PrometheusJsonFormat
+func (c *PrometheusJsonFormatter) Format() string {
+	return PrometheusJsonFormat
+}
+
+// ContentType gets HTTP content type of the output.
+// Returns PrometheusJsonContentType
+func (c *PrometheusJsonFormatter) ContentType() string {
+	return PrometheusJsonContentType
+}
+
+// Accepts checks if the formatter can produce output for a media range from HTTP Accept header.
+//	Parameters:
+//		- mediaType  a lowercase media type.
+//		- params     media type parameters.
+// Returns true for application/json
+func (c *PrometheusJsonFormatter) Accepts(mediaType string, params map[string]string) bool {
+	return mediaType == "application/json"
+}
+
+// Write writes metric families as a JSON list.
+//	Parameters:
+//		- writer    a writer to write output to.
+//		- families  metric families to write.
+// Returns error or nil, if no errors occured.
+func (c *PrometheusJsonFormatter) Write(writer io.Writer, families []*PrometheusMetricFamily) error {
+	if families == nil {
+		families = []*PrometheusMetricFamily{}
+	}
+	return json.NewEncoder(writer).Encode(families)
+}
+
+// WriteSnapshots writes a JSON list of counters sorted by names. Each counter keeps its name, type,
+// labels and all values (last, count, min, max, average, time), so it can be read without Prometheus.
+//	Parameters:
+//		- writer     a writer to write output to.
+//		- snapshots  counter snapshots to write.
+// Returns error or nil, if no errors occured.
+func (c *PrometheusJsonFormatter) WriteSnapshots(writer io.Writer, snapshots []*PrometheusCounterSnapshot) error {
+	result := make([]*PrometheusCounterSnapshot, len(snapshots))
+	copy(result, snapshots)
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return json.NewEncoder(writer).Encode(result)
+}
+
+// DefaultPrometheusFormatters creates formatters of the built-in exposition formats.
+// The text formatter goes first, it is used when no other format is requested.
+// Returns []IPrometheusFormatter
+// text, OpenMetrics, protobuf and JSON formatters
+func DefaultPrometheusFormatters() []IPrometheusFormatter {
+	return []IPrometheusFormatter{
+		NewPrometheusTextFormatter(),
+		NewPrometheusOpenMetricsFormatter(),
+		NewPrometheusProtobufFormatter(),
+		NewPrometheusJsonFormatter(),
+	}
+}
@@ -0,0 +1,178 @@
+package count
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cconv "github.com/pip-services3-gox/pip-services3-commons-gox/convert"
+)
+
+// DefaultPrometheusHistogramBuckets are upper bounds of histogram buckets in milliseconds
+// used for Interval and Statistics counters when buckets are not configured.
+var DefaultPrometheusHistogramBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// PrometheusBucket is a cumulative bucket of a histogram.
+type PrometheusBucket struct {
+	UpperBound      float64 `json:"upper_bound"`
+	CumulativeCount uint64  `json:"cumulative_count"`
+	// Exemplar is the last exemplar of a value that fell into the bucket (nil if there is none).
+	Exemplar *PrometheusExemplar `json:"exemplar"`
+}
+
+// PrometheusHistogramSnapshot is a state of a histogram recorded for Interval or Statistics counter.
+// The implicit +Inf bucket is not included into the list of buckets, it is equal to Count.
+type PrometheusHistogramSnapshot struct {
+	Buckets []PrometheusBucket `json:"buckets"`
+	Count   uint64             `json:"count"`
+	Sum     float64            `json:"sum"`
+	Created time.Time          `json:"created"`
+	// Exemplar is the last exemplar of a value that fell into the implicit +Inf bucket.
+	Exemplar *PrometheusExemplar `json:"exemplar"`
+}
+
+// prometheusHistogram accumulates observations into fixed buckets
+type prometheusHistogram struct {
+	lock      sync.Mutex
+	bounds    []float64
+	counts    []uint64
+	exemplars []*PrometheusExemplar
+	count     uint64
+	sum       float64
+	created   time.Time
+}
+
+func newPrometheusHistogram(bounds []float64) *prometheusHistogram {
+	return &prometheusHistogram{
+		bounds:    bounds,
+		counts:    make([]uint64, len(bounds)),
+		exemplars: make([]*PrometheusExemplar, len(bounds)+1),
+		created:   time.Now(),
+	}
+}
+
+// Records the value and replaces the exemplar of its bucket when the exemplar is not nil
+func (c *prometheusHistogram) observe(value float64, exemplar *PrometheusExemplar) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	index := sort.SearchFloat64s(c.bounds, value)
+	if index < len(c.counts) {
+		c.counts[index]++
+	}
+	if exemplar != nil {
+		c.exemplars[index] = exemplar
+	}
+	c.count++
+	c.sum += value
+}
+
+func (c *prometheusHistogram) snapshot() *PrometheusHistogramSnapshot {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buckets := make([]PrometheusBucket, len(c.bounds))
+	var cumulative uint64
+	for index, bound := range c.bounds {
+		cumulative += c.counts[index]
+		buckets[index] = PrometheusBucket{UpperBound: bound, CumulativeCount: cumulative, Exemplar: c.exemplars[index]}
+	}
+
+	return &PrometheusHistogramSnapshot{
+		Buckets:  buckets,
+		Count:    c.count,
+		Sum:      c.sum,
+		Created:  c.created,
+		Exemplar: c.exemplars[len(c.bounds)],
+	}
+}
+
+// prometheusBucketsRule assigns histogram buckets to counters which names match a pattern
+type prometheusBucketsRule struct {
+	regex   *regexp.Regexp
+	buckets []float64
+}
+
+// prometheusHistogramOptions defines what counters are recorded as histograms and with what buckets
+type prometheusHistogramOptions struct {
+	enabled bool
+	buckets []float64
+	rules   []*prometheusBucketsRule
+}
+
+func newPrometheusHistogramOptions() *prometheusHistogramOptions {
+	return &prometheusHistogramOptions{
+		enabled: false,
+		buckets: DefaultPrometheusHistogramBuckets,
+		rules:   make([]*prometheusBucketsRule, 0),
+	}
+}
+
+// Reads histogram options from options.histograms, histogram.buckets and histogram.rules.<index> sections
+func (c *prometheusHistogramOptions) configure(config *cconf.ConfigParams) error {
+	c.enabled = config.GetAsBooleanWithDefault("options.histograms", c.enabled)
+	if value := config.GetAsString("histogram.buckets"); value != "" {
+		c.buckets = parsePrometheusBuckets(value)
+	}
+
+	section := config.GetSection("histogram.rules")
+	names := sortConfigSectionNames(section.GetSectionNames())
+	if len(names) == 0 {
+		return nil
+	}
+
+	rules := make([]*prometheusBucketsRule, 0, len(names))
+	for _, name := range names {
+		ruleConfig := section.GetSection(name)
+		expression, _ := compilePrometheusPattern(ruleConfig.GetAsString("pattern"))
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return err
+		}
+		buckets := c.buckets
+		if value := ruleConfig.GetAsString("buckets"); value != "" {
+			buckets = parsePrometheusBuckets(value)
+		}
+		rules = append(rules, &prometheusBucketsRule{regex: regex, buckets: buckets})
+	}
+	c.rules = rules
+	return nil
+}
+
+// Gets buckets for the counter or nil if the counter shall not be recorded as histogram
+func (c *prometheusHistogramOptions) bucketsFor(name string) []float64 {
+	for _, rule := range c.rules {
+		if rule.regex.MatchString(name) {
+			return rule.buckets
+		}
+	}
+	if c.enabled {
+		return c.buckets
+	}
+	return nil
+}
+
+// Parses comma-separated list of bucket upper bounds, sorts them and removes duplicates and +Inf
+func parsePrometheusBuckets(value string) []float64 {
+	buckets := make([]float64, 0)
+	for _, item := range strings.Split(value, ",") {
+		bucket, ok := cconv.DoubleConverter.ToNullableDouble(strings.TrimSpace(item))
+		if !ok || math.IsNaN(bucket) || math.IsInf(bucket, 1) {
+			continue
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	sort.Float64s(buckets)
+	result := make([]float64, 0, len(buckets))
+	for index, bucket := range buckets {
+		if index == 0 || bucket != buckets[index-1] {
+			result = append(result, bucket)
+		}
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package count
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// prometheusJsonFloat is a float value that keeps NaN and infinite values in JSON.
+// They can't be represented by JSON numbers, so they are written as "NaN", "+Inf" and "-Inf" strings
+// the same way Prometheus writes them in its HTTP API.
+type prometheusJsonFloat float64
+
+func (c prometheusJsonFloat) MarshalJSON() ([]byte, error) {
+	value := float64(c)
+	switch {
+	case math.IsNaN(value):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(value, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(value, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(value)
+}
+
+// MarshalJSON writes the metric with empty list of labels instead of null
+// and with NaN and infinite values as strings.
+// Returns []byte, error
+// JSON representation of the metric
+func (c PrometheusMetric) MarshalJSON() ([]byte, error) {
+	type metric PrometheusMetric
+	if c.Labels == nil {
+		c.Labels = []PrometheusLabel{}
+	}
+	return json.Marshal(struct {
+		metric
+		Value prometheusJsonFloat `json:"value"`
+		Sum   prometheusJsonFloat `json:"sum"`
+	}{metric(c), prometheusJsonFloat(c.Value), prometheusJsonFloat(c.Sum)})
+}
+
+// MarshalJSON writes the exemplar with NaN and infinite value as a string.
+// Returns []byte, error
+// JSON representation of the exemplar
+func (c PrometheusExemplar) MarshalJSON() ([]byte, error) {
+	type exemplar PrometheusExemplar
+	return json.Marshal(struct {
+		exemplar
+		Value prometheusJsonFloat `json:"value"`
+	}{exemplar(c), prometheusJsonFloat(c.Value)})
+}
+
+// MarshalJSON writes the bucket with infinite upper bound as a string.
+// Returns []byte, error
+// JSON representation of the bucket
+func (c PrometheusBucket) MarshalJSON() ([]byte, error) {
+	type bucket PrometheusBucket
+	return json.Marshal(struct {
+		bucket
+		UpperBound prometheusJsonFloat `json:"upper_bound"`
+	}{bucket(c), prometheusJsonFloat(c.UpperBound)})
+}
+
+// MarshalJSON writes the quantile with NaN and infinite value as a string.
+// Returns []byte, error
+// JSON representation of the quantile
+func (c PrometheusQuantile) MarshalJSON() ([]byte, error) {
+	type quantile PrometheusQuantile
+	return json.Marshal(struct {
+		quantile
+		Value prometheusJsonFloat `json:"value"`
+	}{quantile(c), prometheusJsonFloat(c.Value)})
+}
+
+// MarshalJSON writes the native histogram with NaN and infinite sum as a string.
+// Returns []byte, error
+// JSON representation of the native histogram
+func (c PrometheusNativeHistogramSnapshot) MarshalJSON() ([]byte, error) {
+	type histogram PrometheusNativeHistogramSnapshot
+	return json.Marshal(struct {
+		histogram
+		Sum prometheusJsonFloat `json:"sum"`
+	}{histogram(c), prometheusJsonFloat(c.Sum)})
+}
+
+// MarshalJSON writes the histogram with NaN and infinite sum as a string.
+// Returns []byte, error
+// JSON representation of the histogram
+func (c PrometheusHistogramSnapshot) MarshalJSON() ([]byte, error) {
+	type histogram PrometheusHistogramSnapshot
+	return json.Marshal(struct {
+		histogram
+		Sum prometheusJsonFloat `json:"sum"`
+	}{histogram(c), prometheusJsonFloat(c.Sum)})
+}
+
+// MarshalJSON writes the summary with NaN and infinite sum as a string.
+// Returns []byte, error
+// JSON representation of the summary
+func (c PrometheusSummarySnapshot) MarshalJSON() ([]byte, error) {
+	type summary PrometheusSummarySnapshot
+	return json.Marshal(struct {
+		summary
+		Sum prometheusJsonFloat `json:"sum"`
+	}{summary(c), prometheusJsonFloat(c.Sum)})
+}
+
+// MarshalJSON writes the snapshot with fields of the counter, empty list of labels instead of null
+// and with NaN and infinite values as strings.
+// Returns []byte, error
+// JSON representation of the snapshot
+func (c PrometheusCounterSnapshot) MarshalJSON() ([]byte, error) {
+	type snapshot PrometheusCounterSnapshot
+	if c.Labels == nil {
+		c.Labels = []PrometheusLabel{}
+	}
+	return json.Marshal(struct {
+		snapshot
+		Last    prometheusJsonFloat `json:"last"`
+		Min     prometheusJsonFloat `json:"min"`
+		Max     prometheusJsonFloat `json:"max"`
+		Average prometheusJsonFloat `json:"average"`
+		Sum     prometheusJsonFloat `json:"sum"`
+	}{snapshot(c), prometheusJsonFloat(c.Last), prometheusJsonFloat(c.Min), prometheusJsonFloat(c.Max),
+		prometheusJsonFloat(c.Average), prometheusJsonFloat(c.Sum)})
+}
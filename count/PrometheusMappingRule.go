@@ -0,0 +1,140 @@
+package count
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PrometheusMappingRule defines how a dotted counter name is split into a metric name and labels.
+//
+// A rule can be defined by a template where each * matches exactly one dot-separated segment
+// and ** matches one or more segments, or by a regular expression.
+// Values matched by wildcards (or captured by regular expression groups) are assigned
+// to labels in order. An empty label name or "_" skips the matched value.
+// When no labels are set for a regular expression rule, its named groups are used as labels.
+//
+// The metric name may reference matched values as $1, $2 or ${name}. When the name is empty
+// it is composed from the literal segments of the template.
+//
+// Example:
+//		rule, _ := NewPrometheusMappingRule("*.*.calls", "calls_total", "service", "command")
+//		name, labels, ok := rule.Match("orders.create.calls")
+//		// name = "calls_total", labels = service="orders", command="create"
+type PrometheusMappingRule struct {
+	pattern string
+	name    string
+	labels  []string
+	regex   *regexp.Regexp
+}
+
+// NewPrometheusMappingRule creates a new mapping rule from a template.
+//	Parameters:
+//		- pattern  a template where * matches one segment and ** matches one or more segments.
+//		- name     a metric name. Empty value composes the name from template literals.
+//		- labels   label names for the values matched by wildcards.
+// Returns *PrometheusMappingRule, error
+// pointer on new instance or error if the template can't be compiled
+func NewPrometheusMappingRule(pattern string, name string, labels ...string) (*PrometheusMappingRule, error) {
+	expression, literals := compilePrometheusPattern(pattern)
+
+	if name == "" {
+		name = strings.Join(literals, "_")
+	}
+
+	rule, err := NewPrometheusRegexMappingRule(expression, name, labels...)
+	if err != nil {
+		return nil, err
+	}
+	rule.pattern = pattern
+	return rule, nil
+}
+
+// NewPrometheusRegexMappingRule creates a new mapping rule from a regular expression.
+//	Parameters:
+//		- expression  a regular expression matched against the whole counter name.
+//		- name        a metric name that may reference captured groups. Empty value keeps the counter name.
+//		- labels      label names for the captured groups. Empty list uses names of named groups.
+// Returns *PrometheusMappingRule, error
+// pointer on new instance or error if the expression can't be compiled
+func NewPrometheusRegexMappingRule(expression string, name string, labels ...string) (*PrometheusMappingRule, error) {
+	// The expression is anchored, so it always matches the whole counter name
+	regex, err := regexp.Compile("^(?:" + expression + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(labels) == 0 {
+		labels = regex.SubexpNames()[1:]
+	}
+
+	return &PrometheusMappingRule{
+		pattern: expression,
+		name:    name,
+		labels:  labels,
+		regex:   regex,
+	}, nil
+}
+
+// Pattern gets the template or regular expression of the rule.
+// Returns string
+func (c *PrometheusMappingRule) Pattern() string {
+	return c.pattern
+}
+
+// Match matches the counter name against the rule.
+//	Parameters:
+//		- counterName  a name of the counter.
+// Returns name string, labels []PrometheusLabel, ok bool
+// sanitized metric name and labels extracted from the counter name or false if the rule doesn't match
+func (c *PrometheusMappingRule) Match(counterName string) (string, []PrometheusLabel, bool) {
+	match := c.regex.FindStringSubmatchIndex(counterName)
+	if match == nil {
+		return "", nil, false
+	}
+
+	name := counterName
+	if c.name != "" {
+		name = string(c.regex.ExpandString(nil, c.name, counterName, match))
+	}
+	name = PrometheusNameSanitizer.SanitizeMetricName(strings.ToLower(name))
+	if name == "" {
+		return "", nil, false
+	}
+
+	labels := make([]PrometheusLabel, 0, len(c.labels))
+	for index, label := range c.labels {
+		group := index + 1
+		if label == "" || label == "_" || 2*group+1 >= len(match) || match[2*group] < 0 {
+			continue
+		}
+		labels = append(labels, PrometheusLabel{
+			Name:  PrometheusNameSanitizer.SanitizeLabelName(label),
+			Value: counterName[match[2*group]:match[2*group+1]],
+		})
+	}
+
+	return name, labels, true
+}
+
+// Converts a template where * matches one dot-separated segment and ** matches one or more segments
+// into a regular expression. Literal segments of the template are returned separately.
+func compilePrometheusPattern(pattern string) (string, []string) {
+	segments := strings.Split(pattern, ".")
+	expression := "^"
+	literals := make([]string, 0)
+	for index, segment := range segments {
+		if index > 0 {
+			expression += `\.`
+		}
+		switch segment {
+		case "*":
+			expression += `([^.]+)`
+		case "**":
+			expression += `(.+)`
+		default:
+			expression += regexp.QuoteMeta(segment)
+			literals = append(literals, segment)
+		}
+	}
+	return expression + "$", literals
+}
@@ -0,0 +1,219 @@
+package count
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
+)
+
+// PrometheusMetadata describes metrics exposed for a counter.
+type PrometheusMetadata struct {
+	// Help is a description of the metric shown in HELP lines.
+	Help string `json:"help"`
+	// Unit is a unit of the metric, i.e. seconds or bytes. OpenMetrics requires
+	// metric names to end with _<unit>, so it is only shown for metrics with such names.
+	Unit string `json:"unit"`
+	// Type is an explicit type of metrics of Increment, LastValue and Timestamp counters:
+	// counter, gauge or untyped. Empty value keeps the type chosen by the converter.
+	Type PrometheusMetricType `json:"type"`
+}
+
+// prometheusMetadataEntry assigns metadata to counters which names match a pattern
+type prometheusMetadataEntry struct {
+	pattern  string
+	regex    *regexp.Regexp
+	metadata PrometheusMetadata
+}
+
+// PrometheusMetadataRegistry keeps HELP text, units and explicit types of counters.
+// Metadata is registered for counter names or templates where * matches one dot-separated segment
+// and ** matches one or more segments. Metadata of an exact name takes precedence over templates,
+// templates are checked in the order they were registered. Configuration parameters have no order,
+// so configured templates are registered from the most specific ones: with fewer ** wildcards,
+// then with fewer * wildcards, then with more segments.
+//
+//	Configuration parameters:
+//
+//		- metadata:
+//			- <counter>:
+//				- help:   a description of metrics of the counter
+//				- unit:   (optional) a unit of metrics of the counter, i.e. seconds
+//				- type:   (optional) counter, gauge or untyped
+//
+// Example:
+//		registry := NewPrometheusMetadataRegistry()
+//		registry.Configure(ctx, cconf.NewConfigParamsFromTuples(
+//			"metadata.orders.*.calls.help", "Number of calls of order commands",
+//			"metadata.orders.*.calls.type", "counter",
+//		))
+type PrometheusMetadataRegistry struct {
+	lock     sync.Mutex
+	entries  []*prometheusMetadataEntry
+	fallback *PrometheusMetadataRegistry
+}
+
+// NewPrometheusMetadataRegistry creates a new empty registry.
+// Returns *PrometheusMetadataRegistry
+// pointer on new instance
+func NewPrometheusMetadataRegistry() *PrometheusMetadataRegistry {
+	return &PrometheusMetadataRegistry{
+		entries: make([]*prometheusMetadataEntry, 0),
+	}
+}
+
+// Configure registers metadata from metadata.<counter>.help, unit and type parameters.
+// More specific templates are registered first, so they are checked before more generic ones.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- config   *cconf.ConfigParams
+// configuration parameters to be set.
+// Returns error or nil if all metadata were registered.
+func (c *PrometheusMetadataRegistry) Configure(ctx context.Context, config *cconf.ConfigParams) error {
+	section := config.GetSection("metadata")
+
+	patterns := make(map[string]*PrometheusMetadata)
+	for _, key := range section.Keys() {
+		index := strings.LastIndex(key, ".")
+		if index <= 0 {
+			continue
+		}
+		pattern, field := key[:index], key[index+1:]
+
+		metadata, ok := patterns[pattern]
+		if !ok {
+			metadata = &PrometheusMetadata{}
+		}
+		switch field {
+		case "help":
+			metadata.Help = section.GetAsString(key)
+		case "unit":
+			metadata.Unit = section.GetAsString(key)
+		case "type":
+			metadata.Type = PrometheusMetricType(strings.ToLower(section.GetAsString(key)))
+		default:
+			continue
+		}
+		patterns[pattern] = metadata
+	}
+
+	names := make([]string, 0, len(patterns))
+	for pattern := range patterns {
+		names = append(names, pattern)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return prometheusPatternLess(names[i], names[j])
+	})
+
+	for _, pattern := range names {
+		if err := c.Register(pattern, *patterns[pattern]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks if the first pattern is more specific than the second one.
+// Patterns of the same specificity are ordered by names to keep the order stable.
+func prometheusPatternLess(first string, second string) bool {
+	firstDoubles, secondDoubles := strings.Count(first, "**"), strings.Count(second, "**")
+	if firstDoubles != secondDoubles {
+		return firstDoubles < secondDoubles
+	}
+	firstSingles, secondSingles := strings.Count(first, "*")-2*firstDoubles, strings.Count(second, "*")-2*secondDoubles
+	if firstSingles != secondSingles {
+		return firstSingles < secondSingles
+	}
+	firstSegments, secondSegments := strings.Count(first, "."), strings.Count(second, ".")
+	if firstSegments != secondSegments {
+		return firstSegments > secondSegments
+	}
+	return first < second
+}
+
+// Register sets metadata of counters with the name or matching the template.
+// It replaces metadata registered before for the same name or template.
+//	Parameters:
+//		- pattern   a counter name or a template, i.e. orders.*.calls.
+//		- metadata  metadata of the counters.
+// Returns error or nil, if the pattern or the type is invalid.
+func (c *PrometheusMetadataRegistry) Register(pattern string, metadata PrometheusMetadata) error {
+	switch metadata.Type {
+	case "", PrometheusTypeCounter, PrometheusTypeGauge, PrometheusTypeUntyped:
+	default:
+		return cerr.NewConfigError("", "INVALID_METRIC_TYPE", "Metric type shall be counter, gauge or untyped").
+			WithDetails("pattern", pattern).WithDetails("type", metadata.Type)
+	}
+
+	expression, _ := compilePrometheusPattern(pattern)
+	regex, err := regexp.Compile(expression)
+	if pattern == "" || err != nil {
+		return cerr.NewConfigError("", "INVALID_PATTERN", "Invalid pattern of counter names").
+			WithDetails("pattern", pattern).WithCause(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.pattern == pattern {
+			entry.metadata = metadata
+			return nil
+		}
+	}
+	c.entries = append(c.entries, &prometheusMetadataEntry{pattern: pattern, regex: regex, metadata: metadata})
+	return nil
+}
+
+// Find gets metadata of the counter.
+// When no metadata is registered for the counter it is looked up in the fallback registry.
+//	Parameters:
+//		- name  a counter name.
+// Returns PrometheusMetadata, bool
+// metadata of the counter and true, or false if metadata is not found
+func (c *PrometheusMetadataRegistry) Find(name string) (PrometheusMetadata, bool) {
+	c.lock.Lock()
+	var found *prometheusMetadataEntry
+	for _, entry := range c.entries {
+		if entry.pattern == name {
+			found = entry
+			break
+		}
+		if found == nil && entry.regex.MatchString(name) {
+			found = entry
+		}
+	}
+	fallback := c.fallback
+	c.lock.Unlock()
+
+	if found != nil {
+		return found.metadata, true
+	}
+	if fallback != nil {
+		return fallback.Find(name)
+	}
+	return PrometheusMetadata{}, false
+}
+
+// SetFallback sets a registry where metadata is looked up when it is not registered here.
+// PrometheusMetricsService uses it to expose metadata registered in PrometheusCounters.
+//	Parameters:
+//		- fallback  a fallback registry or nil.
+func (c *PrometheusMetadataRegistry) SetFallback(fallback *PrometheusMetadataRegistry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.fallback = fallback
+}
+
+// Clear removes all registered metadata.
+func (c *PrometheusMetadataRegistry) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make([]*prometheusMetadataEntry, 0)
+}
@@ -0,0 +1,69 @@
+package count
+
+import (
+	"time"
+)
+
+// PrometheusMetricType defines a type of Prometheus metric family.
+type PrometheusMetricType string
+
+const (
+	PrometheusTypeCounter   PrometheusMetricType = "counter"
+	PrometheusTypeGauge     PrometheusMetricType = "gauge"
+	PrometheusTypeHistogram PrometheusMetricType = "histogram"
+	PrometheusTypeSummary   PrometheusMetricType = "summary"
+	PrometheusTypeUntyped   PrometheusMetricType = "untyped"
+)
+
+// PrometheusLabel is a single name/value pair that identifies a metric series.
+type PrometheusLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PrometheusMetric is a single series inside a metric family.
+type PrometheusMetric struct {
+	Labels []PrometheusLabel `json:"labels"`
+	Value  float64           `json:"value"`
+	// Created is the time when a counter started to accumulate its value (zero if unknown).
+	Created time.Time `json:"created"`
+	// Count is a number of observations of histogram or summary.
+	Count uint64 `json:"count"`
+	// Sum is a sum of observations of histogram or summary.
+	Sum float64 `json:"sum"`
+	// Buckets are cumulative buckets of histogram without the implicit +Inf bucket.
+	Buckets []PrometheusBucket `json:"buckets"`
+	// Quantiles are estimated quantiles of summary.
+	Quantiles []PrometheusQuantile `json:"quantiles"`
+	// Exemplar is an exemplar of counter sample or of +Inf bucket of histogram
+	// (only exposed in OpenMetrics and protobuf formats).
+	Exemplar *PrometheusExemplar `json:"exemplar"`
+	// NativeHistogram is a native histogram state (only exposed in protobuf format).
+	NativeHistogram *PrometheusNativeHistogramSnapshot `json:"native_histogram"`
+}
+
+// PrometheusMetricFamily is a group of series that share the same name, type and metadata.
+// Metric families are produced by PrometheusCounterConverter from performance counters
+// and rendered by exposition writers into text, OpenMetrics or other formats.
+// Names of counter families don't include _total suffix, it is added by exposition writers.
+type PrometheusMetricFamily struct {
+	Name    string               `json:"name"`
+	Help    string               `json:"help"`
+	Unit    string               `json:"unit"`
+	Type    PrometheusMetricType `json:"type"`
+	Metrics []*PrometheusMetric  `json:"metrics"`
+}
+
+// NewPrometheusMetricFamily creates a new empty metric family.
+//	Parameters:
+//		- name  a metric family name.
+//		- typ   a metric family type.
+// Returns *PrometheusMetricFamily
+// pointer on new instance
+func NewPrometheusMetricFamily(name string, typ PrometheusMetricType) *PrometheusMetricFamily {
+	return &PrometheusMetricFamily{
+		Name:    name,
+		Type:    typ,
+		Metrics: make([]*PrometheusMetric, 0),
+	}
+}
@@ -0,0 +1,114 @@
+package count
+
+import (
+	"strings"
+)
+
+// PrometheusNameSanitizer is helper class that turns arbitrary strings into valid
+// Prometheus metric and label names and escapes label values and HELP text.
+//
+// Metric names must match [a-zA-Z_:][a-zA-Z0-9_:]* and label names must match [a-zA-Z_][a-zA-Z0-9_]*.
+// Label names that start with __ are reserved for internal use by Prometheus.
+var PrometheusNameSanitizer TPrometheusNameSanitizer = TPrometheusNameSanitizer{}
+
+type TPrometheusNameSanitizer struct {
+}
+
+// SanitizeMetricName converts a string into a valid metric name.
+// Invalid characters are replaced with underscores and a leading digit is prefixed with an underscore.
+//	Parameters:
+//		- name  a name to sanitize.
+// Returns string
+// a valid metric name or empty string if the name is empty
+func (c *TPrometheusNameSanitizer) SanitizeMetricName(name string) string {
+	return c.sanitize(name, true)
+}
+
+// SanitizeLabelName converts a string into a valid label name.
+// Invalid characters are replaced with underscores, a leading digit is prefixed with an underscore
+// and reserved double underscore prefix is reduced to a single one.
+//	Parameters:
+//		- name  a name to sanitize.
+// Returns string
+// a valid label name or empty string if the name is empty
+func (c *TPrometheusNameSanitizer) SanitizeLabelName(name string) string {
+	result := c.sanitize(name, false)
+	for strings.HasPrefix(result, "__") {
+		result = result[1:]
+	}
+	return result
+}
+
+// IsValidMetricName checks if a string is a valid metric name.
+//	Parameters:
+//		- name  a name to check.
+// Returns bool
+// true if the name is valid and false otherwise
+func (c *TPrometheusNameSanitizer) IsValidMetricName(name string) bool {
+	return name != "" && c.sanitize(name, true) == name
+}
+
+// IsValidLabelName checks if a string is a valid label name.
+//	Parameters:
+//		- name  a name to check.
+// Returns bool
+// true if the name is valid and false otherwise
+func (c *TPrometheusNameSanitizer) IsValidLabelName(name string) bool {
+	return name != "" && c.sanitize(name, false) == name
+}
+
+// EscapeLabelValue escapes backslashes, double quotes and line feeds in a label value.
+// Invalid UTF-8 sequences are replaced with the replacement character.
+//	Parameters:
+//		- value  a label value to escape.
+// Returns string
+// escaped label value
+func (c *TPrometheusNameSanitizer) EscapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(strings.ToValidUTF8(value, "\uFFFD"))
+}
+
+// EscapeHelp escapes backslashes and line feeds in HELP text of the classic text format.
+//	Parameters:
+//		- help  a help text to escape.
+// Returns string
+// escaped help text
+func (c *TPrometheusNameSanitizer) EscapeHelp(help string) string {
+	return helpReplacer.Replace(strings.ToValidUTF8(help, "\uFFFD"))
+}
+
+// EscapeOpenMetricsHelp escapes backslashes, double quotes and line feeds in HELP text of OpenMetrics format.
+//	Parameters:
+//		- help  a help text to escape.
+// Returns string
+// escaped help text
+func (c *TPrometheusNameSanitizer) EscapeOpenMetricsHelp(help string) string {
+	return labelValueReplacer.Replace(strings.ToValidUTF8(help, "\uFFFD"))
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func (c *TPrometheusNameSanitizer) sanitize(name string, allowColon bool) string {
+	if name == "" {
+		return ""
+	}
+
+	builder := strings.Builder{}
+	builder.Grow(len(name) + 1)
+	for index, char := range name {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char == '_':
+			builder.WriteRune(char)
+		case char == ':' && allowColon:
+			builder.WriteRune(char)
+		case char >= '0' && char <= '9':
+			if index == 0 {
+				builder.WriteByte('_')
+			}
+			builder.WriteRune(char)
+		default:
+			builder.WriteByte('_')
+		}
+	}
+	return builder.String()
+}
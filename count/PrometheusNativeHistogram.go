@@ -0,0 +1,272 @@
+package count
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+)
+
+const (
+	// DefaultPrometheusNativeHistogramSchema is a default resolution of native histograms.
+	// Schema 3 means that each power of 2 is divided into 2^3 = 8 buckets.
+	DefaultPrometheusNativeHistogramSchema int32 = 3
+	// DefaultPrometheusNativeHistogramMaxBuckets is a default number of populated buckets after
+	// which the resolution of native histogram is reduced.
+	DefaultPrometheusNativeHistogramMaxBuckets = 160
+
+	minPrometheusNativeHistogramSchema int32 = -4
+	maxPrometheusNativeHistogramSchema int32 = 8
+)
+
+// DefaultPrometheusNativeHistogramZeroThreshold is a default width of the zero bucket of native histograms.
+var DefaultPrometheusNativeHistogramZeroThreshold = math.Ldexp(1, -128)
+
+// PrometheusBucketSpan is a range of consecutive buckets of native histogram.
+// Offset is a gap to the previous span or the starting index for the first span.
+type PrometheusBucketSpan struct {
+	Offset int32  `json:"offset"`
+	Length uint32 `json:"length"`
+}
+
+// PrometheusNativeHistogramSnapshot is a state of a native (sparse exponential) histogram.
+// Bucket counts are encoded as deltas to the previous bucket like in Prometheus protobuf format.
+// Native histograms can only be exposed in protobuf format.
+type PrometheusNativeHistogramSnapshot struct {
+	Schema         int32                  `json:"schema"`
+	ZeroThreshold  float64                `json:"zero_threshold"`
+	ZeroCount      uint64                 `json:"zero_count"`
+	PositiveSpans  []PrometheusBucketSpan `json:"positive_spans"`
+	PositiveDeltas []int64                `json:"positive_deltas"`
+	NegativeSpans  []PrometheusBucketSpan `json:"negative_spans"`
+	NegativeDeltas []int64                `json:"negative_deltas"`
+	Count          uint64                 `json:"count"`
+	Sum            float64                `json:"sum"`
+	Created        time.Time              `json:"created"`
+}
+
+// prometheusNativeHistogram accumulates observations into exponential buckets.
+// A bucket with index i covers values in (base^(i-1), base^i] where base = 2^(2^-schema).
+type prometheusNativeHistogram struct {
+	lock          sync.Mutex
+	schema        int32
+	zeroThreshold float64
+	maxBuckets    int
+	zeroCount     uint64
+	positive      map[int]uint64
+	negative      map[int]uint64
+	count         uint64
+	sum           float64
+	created       time.Time
+}
+
+func newPrometheusNativeHistogram(schema int32, zeroThreshold float64, maxBuckets int) *prometheusNativeHistogram {
+	if schema < minPrometheusNativeHistogramSchema {
+		schema = minPrometheusNativeHistogramSchema
+	}
+	if schema > maxPrometheusNativeHistogramSchema {
+		schema = maxPrometheusNativeHistogramSchema
+	}
+
+	return &prometheusNativeHistogram{
+		schema:        schema,
+		zeroThreshold: math.Abs(zeroThreshold),
+		maxBuckets:    maxBuckets,
+		positive:      make(map[int]uint64),
+		negative:      make(map[int]uint64),
+		created:       time.Now(),
+	}
+}
+
+func (c *prometheusNativeHistogram) observe(value float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.count++
+	c.sum += value
+
+	switch {
+	case math.IsNaN(value):
+		return
+	case math.Abs(value) <= c.zeroThreshold:
+		c.zeroCount++
+	case value > 0:
+		c.positive[nativeHistogramBucketIndex(value, c.schema)]++
+	default:
+		c.negative[nativeHistogramBucketIndex(-value, c.schema)]++
+	}
+
+	for c.maxBuckets > 0 && len(c.positive)+len(c.negative) > c.maxBuckets && c.schema > minPrometheusNativeHistogramSchema {
+		c.reduceSchema()
+	}
+}
+
+// Halves the resolution by merging each pair of neighbouring buckets
+func (c *prometheusNativeHistogram) reduceSchema() {
+	c.schema--
+	c.positive = mergeNativeHistogramBuckets(c.positive)
+	c.negative = mergeNativeHistogramBuckets(c.negative)
+}
+
+func mergeNativeHistogramBuckets(buckets map[int]uint64) map[int]uint64 {
+	result := make(map[int]uint64, len(buckets)/2+1)
+	for index, count := range buckets {
+		// Bucket i of the finer schema falls into bucket ceil(i/2) of the coarser one
+		result[(index+1)>>1] += count
+	}
+	return result
+}
+
+func (c *prometheusNativeHistogram) snapshot() *PrometheusNativeHistogramSnapshot {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	positiveSpans, positiveDeltas := nativeHistogramSpans(c.positive)
+	negativeSpans, negativeDeltas := nativeHistogramSpans(c.negative)
+
+	return &PrometheusNativeHistogramSnapshot{
+		Schema:         c.schema,
+		ZeroThreshold:  c.zeroThreshold,
+		ZeroCount:      c.zeroCount,
+		PositiveSpans:  positiveSpans,
+		PositiveDeltas: positiveDeltas,
+		NegativeSpans:  negativeSpans,
+		NegativeDeltas: negativeDeltas,
+		Count:          c.count,
+		Sum:            c.sum,
+		Created:        c.created,
+	}
+}
+
+// Converts sparse buckets into spans of consecutive buckets and deltas of their counts
+func nativeHistogramSpans(buckets map[int]uint64) ([]PrometheusBucketSpan, []int64) {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	spans := make([]PrometheusBucketSpan, 0)
+	deltas := make([]int64, 0, len(indexes))
+	var previousCount int64
+	for position, index := range indexes {
+		if position == 0 {
+			spans = append(spans, PrometheusBucketSpan{Offset: int32(index), Length: 1})
+		} else if gap := index - indexes[position-1] - 1; gap > 0 {
+			spans = append(spans, PrometheusBucketSpan{Offset: int32(gap), Length: 1})
+		} else {
+			spans[len(spans)-1].Length++
+		}
+
+		count := int64(buckets[index])
+		deltas = append(deltas, count-previousCount)
+		previousCount = count
+	}
+	return spans, deltas
+}
+
+// Calculates index of the bucket for a positive value in the given schema
+func nativeHistogramBucketIndex(value float64, schema int32) int {
+	frac, exp := math.Frexp(value)
+	if schema > 0 {
+		bounds := nativeHistogramBounds(schema)
+		return sort.SearchFloat64s(bounds, frac) + (exp-1)*len(bounds)
+	}
+
+	index := exp
+	if frac == 0.5 {
+		index--
+	}
+	offset := (1 << -schema) - 1
+	return (index + offset) >> -schema
+}
+
+var nativeHistogramBoundsCache = map[int32][]float64{}
+var nativeHistogramBoundsLock sync.Mutex
+
+// Gets upper bounds of buckets within one power of 2 for a positive schema normalized to [0.5, 1)
+func nativeHistogramBounds(schema int32) []float64 {
+	nativeHistogramBoundsLock.Lock()
+	defer nativeHistogramBoundsLock.Unlock()
+
+	if bounds, ok := nativeHistogramBoundsCache[schema]; ok {
+		return bounds
+	}
+
+	size := 1 << schema
+	bounds := make([]float64, size)
+	for index := range bounds {
+		bounds[index] = math.Exp2(float64(index)/float64(size)) / 2
+	}
+	nativeHistogramBoundsCache[schema] = bounds
+	return bounds
+}
+
+// prometheusNativeHistogramRule enables native histograms for counters which names match a pattern
+type prometheusNativeHistogramRule struct {
+	regex  *regexp.Regexp
+	schema int32
+}
+
+// prometheusNativeHistogramOptions defines what counters are recorded as native histograms and how
+type prometheusNativeHistogramOptions struct {
+	enabled       bool
+	schema        int32
+	zeroThreshold float64
+	maxBuckets    int
+	rules         []*prometheusNativeHistogramRule
+}
+
+func newPrometheusNativeHistogramOptions() *prometheusNativeHistogramOptions {
+	return &prometheusNativeHistogramOptions{
+		enabled:       false,
+		schema:        DefaultPrometheusNativeHistogramSchema,
+		zeroThreshold: DefaultPrometheusNativeHistogramZeroThreshold,
+		maxBuckets:    DefaultPrometheusNativeHistogramMaxBuckets,
+		rules:         make([]*prometheusNativeHistogramRule, 0),
+	}
+}
+
+// Reads native histogram options from options.native_histograms and native_histogram sections
+func (c *prometheusNativeHistogramOptions) configure(config *cconf.ConfigParams) error {
+	c.enabled = config.GetAsBooleanWithDefault("options.native_histograms", c.enabled)
+	c.schema = int32(config.GetAsIntegerWithDefault("native_histogram.schema", int(c.schema)))
+	c.zeroThreshold = config.GetAsDoubleWithDefault("native_histogram.zero_threshold", c.zeroThreshold)
+	c.maxBuckets = config.GetAsIntegerWithDefault("native_histogram.max_buckets", c.maxBuckets)
+
+	section := config.GetSection("native_histogram.rules")
+	names := sortConfigSectionNames(section.GetSectionNames())
+	if len(names) == 0 {
+		return nil
+	}
+
+	rules := make([]*prometheusNativeHistogramRule, 0, len(names))
+	for _, name := range names {
+		ruleConfig := section.GetSection(name)
+		expression, _ := compilePrometheusPattern(ruleConfig.GetAsString("pattern"))
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return err
+		}
+		schema := int32(ruleConfig.GetAsIntegerWithDefault("schema", int(c.schema)))
+		rules = append(rules, &prometheusNativeHistogramRule{regex: regex, schema: schema})
+	}
+	c.rules = rules
+	return nil
+}
+
+// Creates a native histogram for the counter or nil if the counter shall not be recorded as native histogram
+func (c *prometheusNativeHistogramOptions) histogramFor(name string) *prometheusNativeHistogram {
+	for _, rule := range c.rules {
+		if rule.regex.MatchString(name) {
+			return newPrometheusNativeHistogram(rule.schema, c.zeroThreshold, c.maxBuckets)
+		}
+	}
+	if c.enabled {
+		return newPrometheusNativeHistogram(c.schema, c.zeroThreshold, c.maxBuckets)
+	}
+	return nil
+}
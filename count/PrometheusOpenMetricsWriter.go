@@ -0,0 +1,63 @@
+package count
+
+import (
+	"strings"
+)
+
+// Writes metric families in the OpenMetrics 1.0 text exposition format
+// and terminates the output with # EOF line.
+//	Parameters:
+//		- writer    a writer to write to
+//		- families  metric families to write
+func writeOpenMetricsFamilies(writer *prometheusTextWriter, families []*PrometheusMetricFamily) {
+	for _, family := range families {
+		typ := family.Type
+		if typ == PrometheusTypeUntyped {
+			typ = "unknown"
+		}
+
+		writer.WriteString("# TYPE ")
+		writer.WriteString(family.Name)
+		writer.WriteByte(' ')
+		writer.WriteString(string(typ))
+		writer.WriteByte('\n')
+		if family.Unit != "" && strings.HasSuffix(family.Name, "_"+family.Unit) {
+			writer.WriteString("# UNIT ")
+			writer.WriteString(family.Name)
+			writer.WriteByte(' ')
+			writer.WriteString(family.Unit)
+			writer.WriteByte('\n')
+		}
+		if family.Help != "" {
+			writer.WriteString("# HELP ")
+			writer.WriteString(family.Name)
+			writer.WriteByte(' ')
+			writer.WriteString(PrometheusNameSanitizer.EscapeOpenMetricsHelp(family.Help))
+			writer.WriteByte('\n')
+		}
+
+		for _, metric := range family.Metrics {
+			writer.setLabels(metric.Labels)
+			switch family.Type {
+			case PrometheusTypeCounter:
+				writer.writeExemplarSample(family.Name, "_total", metric.Value, metric.Exemplar)
+				writer.writeCreatedSample(family.Name, metric)
+			case PrometheusTypeHistogram:
+				writer.writeHistogramSamples(family.Name, metric, true)
+				writer.writeCreatedSample(family.Name, metric)
+			case PrometheusTypeSummary:
+				writer.writeSummarySamples(family.Name, metric)
+				writer.writeCreatedSample(family.Name, metric)
+			default:
+				writer.writeSample(family.Name, "", metric.Value)
+			}
+		}
+	}
+	writer.WriteString("# EOF\n")
+}
+
+func (c *prometheusTextWriter) writeCreatedSample(name string, metric *PrometheusMetric) {
+	if !metric.Created.IsZero() {
+		c.writeSample(name, "_created", float64(metric.Created.UnixNano())/1e9)
+	}
+}
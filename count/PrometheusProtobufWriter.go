@@ -0,0 +1,306 @@
+package count
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+)
+
+// Field numbers and wire types of io.prometheus.client protobuf messages (metrics.proto)
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+
+	protoMetricFamilyName   = 1
+	protoMetricFamilyHelp   = 2
+	protoMetricFamilyType   = 3
+	protoMetricFamilyMetric = 4
+	protoMetricFamilyUnit   = 5
+
+	protoMetricLabel     = 1
+	protoMetricGauge     = 2
+	protoMetricCounter   = 3
+	protoMetricSummary   = 4
+	protoMetricUntyped   = 5
+	protoMetricHistogram = 7
+
+	protoLabelPairName  = 1
+	protoLabelPairValue = 2
+
+	protoValue = 1
+
+	protoCounterExemplar = 2
+	protoCounterCreated  = 3
+
+	protoHistogramSampleCount = 1
+	protoHistogramSampleSum   = 2
+	protoHistogramBucket      = 3
+	protoHistogramCreated     = 15
+
+	protoHistogramSchema        = 5
+	protoHistogramZeroThreshold = 6
+	protoHistogramZeroCount     = 7
+	protoHistogramNegativeSpan  = 9
+	protoHistogramNegativeDelta = 10
+	protoHistogramPositiveSpan  = 12
+	protoHistogramPositiveDelta = 13
+
+	protoBucketSpanOffset = 1
+	protoBucketSpanLength = 2
+
+	protoSummarySampleCount = 1
+	protoSummarySampleSum   = 2
+	protoSummaryQuantile    = 3
+	protoSummaryCreated     = 4
+
+	protoQuantileQuantile = 1
+	protoQuantileValue    = 2
+
+	protoBucketCumulativeCount = 1
+	protoBucketUpperBound      = 2
+	protoBucketExemplar        = 3
+
+	protoExemplarLabel     = 1
+	protoExemplarValue     = 2
+	protoExemplarTimestamp = 3
+
+	protoTimestampSeconds = 1
+	protoTimestampNanos   = 2
+)
+
+// Values of io.prometheus.client.MetricType enumeration
+const (
+	protoTypeCounter   = 0
+	protoTypeGauge     = 1
+	protoTypeSummary   = 2
+	protoTypeUntyped   = 3
+	protoTypeHistogram = 4
+)
+
+// Writes metric families as a stream of length-delimited io.prometheus.client.MetricFamily messages
+//
+//	Parameters:
+//		- buffer    a buffer to append encoded messages to
+//		- families  metric families to write
+//
+// Returns []byte
+// the extended buffer
+func writeProtobufFamilies(buffer []byte, families []*PrometheusMetricFamily) []byte {
+	for _, family := range families {
+		message := encodeProtobufFamily(family)
+		buffer = appendUvarint(buffer, uint64(len(message)))
+		buffer = append(buffer, message...)
+	}
+	return buffer
+}
+
+func encodeProtobufFamily(family *PrometheusMetricFamily) []byte {
+	name := family.Name
+	if family.Type == PrometheusTypeCounter {
+		name += "_total"
+	}
+
+	buffer := make([]byte, 0, 64)
+	buffer = appendProtoString(buffer, protoMetricFamilyName, name)
+	if family.Help != "" {
+		buffer = appendProtoString(buffer, protoMetricFamilyHelp, strings.ToValidUTF8(family.Help, "�"))
+	}
+	buffer = appendProtoVarint(buffer, protoMetricFamilyType, protobufMetricType(family.Type))
+	for _, metric := range family.Metrics {
+		buffer = appendProtoBytes(buffer, protoMetricFamilyMetric, encodeProtobufMetric(family.Type, metric))
+	}
+	if family.Unit != "" {
+		buffer = appendProtoString(buffer, protoMetricFamilyUnit, family.Unit)
+	}
+	return buffer
+}
+
+func encodeProtobufMetric(typ PrometheusMetricType, metric *PrometheusMetric) []byte {
+	buffer := make([]byte, 0, 64)
+	for _, label := range metric.Labels {
+		pair := make([]byte, 0, len(label.Name)+len(label.Value)+4)
+		pair = appendProtoString(pair, protoLabelPairName, label.Name)
+		pair = appendProtoString(pair, protoLabelPairValue, strings.ToValidUTF8(label.Value, "�"))
+		buffer = appendProtoBytes(buffer, protoMetricLabel, pair)
+	}
+
+	value := appendProtoDouble(make([]byte, 0, 9), protoValue, metric.Value)
+	switch typ {
+	case PrometheusTypeCounter:
+		if metric.Exemplar != nil {
+			value = appendProtoBytes(value, protoCounterExemplar, encodeProtobufExemplar(metric.Exemplar))
+		}
+		if !metric.Created.IsZero() {
+			value = appendProtoBytes(value, protoCounterCreated, encodeProtobufTimestamp(metric.Created))
+		}
+		buffer = appendProtoBytes(buffer, protoMetricCounter, value)
+	case PrometheusTypeGauge:
+		buffer = appendProtoBytes(buffer, protoMetricGauge, value)
+	case PrometheusTypeHistogram:
+		buffer = appendProtoBytes(buffer, protoMetricHistogram, encodeProtobufHistogram(metric))
+	case PrometheusTypeSummary:
+		buffer = appendProtoBytes(buffer, protoMetricSummary, encodeProtobufSummary(metric))
+	default:
+		buffer = appendProtoBytes(buffer, protoMetricUntyped, value)
+	}
+	return buffer
+}
+
+func encodeProtobufHistogram(metric *PrometheusMetric) []byte {
+	buffer := make([]byte, 0, 32+len(metric.Buckets)*16)
+	buffer = appendProtoVarint(buffer, protoHistogramSampleCount, metric.Count)
+	buffer = appendProtoDouble(buffer, protoHistogramSampleSum, metric.Sum)
+	for _, bucket := range metric.Buckets {
+		buffer = appendProtoBytes(buffer, protoHistogramBucket, encodeProtobufBucket(bucket))
+	}
+	if metric.Exemplar != nil {
+		// The implicit +Inf bucket is written only to carry its exemplar
+		bucket := PrometheusBucket{UpperBound: math.Inf(1), CumulativeCount: metric.Count, Exemplar: metric.Exemplar}
+		buffer = appendProtoBytes(buffer, protoHistogramBucket, encodeProtobufBucket(bucket))
+	}
+	if native := metric.NativeHistogram; native != nil {
+		buffer = appendProtoVarint(buffer, protoHistogramSchema, encodeZigZag(int64(native.Schema)))
+		buffer = appendProtoDouble(buffer, protoHistogramZeroThreshold, native.ZeroThreshold)
+		buffer = appendProtoVarint(buffer, protoHistogramZeroCount, native.ZeroCount)
+		buffer = appendProtobufSpans(buffer, protoHistogramNegativeSpan, native.NegativeSpans)
+		buffer = appendProtobufDeltas(buffer, protoHistogramNegativeDelta, native.NegativeDeltas)
+		positiveSpans := native.PositiveSpans
+		if len(positiveSpans) == 0 && len(native.NegativeSpans) == 0 && native.ZeroThreshold == 0 && native.ZeroCount == 0 {
+			// An empty span marks the histogram as native when it has no observations yet
+			positiveSpans = []PrometheusBucketSpan{{Offset: 0, Length: 0}}
+		}
+		buffer = appendProtobufSpans(buffer, protoHistogramPositiveSpan, positiveSpans)
+		buffer = appendProtobufDeltas(buffer, protoHistogramPositiveDelta, native.PositiveDeltas)
+	}
+	if !metric.Created.IsZero() {
+		buffer = appendProtoBytes(buffer, protoHistogramCreated, encodeProtobufTimestamp(metric.Created))
+	}
+	return buffer
+}
+
+func encodeProtobufBucket(bucket PrometheusBucket) []byte {
+	buffer := make([]byte, 0, 16)
+	buffer = appendProtoVarint(buffer, protoBucketCumulativeCount, bucket.CumulativeCount)
+	buffer = appendProtoDouble(buffer, protoBucketUpperBound, bucket.UpperBound)
+	if bucket.Exemplar != nil {
+		buffer = appendProtoBytes(buffer, protoBucketExemplar, encodeProtobufExemplar(bucket.Exemplar))
+	}
+	return buffer
+}
+
+func encodeProtobufExemplar(exemplar *PrometheusExemplar) []byte {
+	buffer := make([]byte, 0, 64)
+	for _, label := range exemplar.Labels {
+		pair := make([]byte, 0, len(label.Name)+len(label.Value)+4)
+		pair = appendProtoString(pair, protoLabelPairName, label.Name)
+		pair = appendProtoString(pair, protoLabelPairValue, strings.ToValidUTF8(label.Value, "\uFFFD"))
+		buffer = appendProtoBytes(buffer, protoExemplarLabel, pair)
+	}
+	buffer = appendProtoDouble(buffer, protoExemplarValue, exemplar.Value)
+	if !exemplar.Timestamp.IsZero() {
+		buffer = appendProtoBytes(buffer, protoExemplarTimestamp, encodeProtobufTimestamp(exemplar.Timestamp))
+	}
+	return buffer
+}
+
+func appendProtobufSpans(buffer []byte, field int, spans []PrometheusBucketSpan) []byte {
+	for _, span := range spans {
+		encoded := make([]byte, 0, 12)
+		encoded = appendProtoVarint(encoded, protoBucketSpanOffset, encodeZigZag(int64(span.Offset)))
+		encoded = appendProtoVarint(encoded, protoBucketSpanLength, uint64(span.Length))
+		buffer = appendProtoBytes(buffer, field, encoded)
+	}
+	return buffer
+}
+
+// Writes deltas as a packed repeated sint64 field
+func appendProtobufDeltas(buffer []byte, field int, deltas []int64) []byte {
+	if len(deltas) == 0 {
+		return buffer
+	}
+	packed := make([]byte, 0, len(deltas)*2)
+	for _, delta := range deltas {
+		packed = appendUvarint(packed, encodeZigZag(delta))
+	}
+	return appendProtoBytes(buffer, field, packed)
+}
+
+func encodeZigZag(value int64) uint64 {
+	return uint64((value << 1) ^ (value >> 63))
+}
+
+func encodeProtobufSummary(metric *PrometheusMetric) []byte {
+	buffer := make([]byte, 0, 32+len(metric.Quantiles)*20)
+	buffer = appendProtoVarint(buffer, protoSummarySampleCount, metric.Count)
+	buffer = appendProtoDouble(buffer, protoSummarySampleSum, metric.Sum)
+	for _, quantile := range metric.Quantiles {
+		encoded := make([]byte, 0, 18)
+		encoded = appendProtoDouble(encoded, protoQuantileQuantile, quantile.Quantile)
+		encoded = appendProtoDouble(encoded, protoQuantileValue, quantile.Value)
+		buffer = appendProtoBytes(buffer, protoSummaryQuantile, encoded)
+	}
+	if !metric.Created.IsZero() {
+		buffer = appendProtoBytes(buffer, protoSummaryCreated, encodeProtobufTimestamp(metric.Created))
+	}
+	return buffer
+}
+
+func encodeProtobufTimestamp(value time.Time) []byte {
+	buffer := make([]byte, 0, 16)
+	buffer = appendProtoVarint(buffer, protoTimestampSeconds, uint64(value.Unix()))
+	if nanos := value.Nanosecond(); nanos != 0 {
+		buffer = appendProtoVarint(buffer, protoTimestampNanos, uint64(nanos))
+	}
+	return buffer
+}
+
+func protobufMetricType(typ PrometheusMetricType) uint64 {
+	switch typ {
+	case PrometheusTypeCounter:
+		return protoTypeCounter
+	case PrometheusTypeGauge:
+		return protoTypeGauge
+	case PrometheusTypeSummary:
+		return protoTypeSummary
+	case PrometheusTypeHistogram:
+		return protoTypeHistogram
+	default:
+		return protoTypeUntyped
+	}
+}
+
+func appendProtoTag(buffer []byte, field int, wireType int) []byte {
+	return appendUvarint(buffer, uint64(field<<3|wireType))
+}
+
+func appendProtoVarint(buffer []byte, field int, value uint64) []byte {
+	buffer = appendProtoTag(buffer, field, protoWireVarint)
+	return appendUvarint(buffer, value)
+}
+
+func appendProtoDouble(buffer []byte, field int, value float64) []byte {
+	buffer = appendProtoTag(buffer, field, protoWireFixed64)
+	var bytes [8]byte
+	binary.LittleEndian.PutUint64(bytes[:], math.Float64bits(value))
+	return append(buffer, bytes[:]...)
+}
+
+func appendProtoBytes(buffer []byte, field int, value []byte) []byte {
+	buffer = appendProtoTag(buffer, field, protoWireBytes)
+	buffer = appendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendProtoString(buffer []byte, field int, value string) []byte {
+	buffer = appendProtoTag(buffer, field, protoWireBytes)
+	buffer = appendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var bytes [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(bytes[:], value)
+	return append(buffer, bytes[:size]...)
+}
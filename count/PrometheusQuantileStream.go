@@ -0,0 +1,148 @@
+package count
+
+import (
+	"math"
+	"sort"
+)
+
+// prometheusQuantileSample is a compressed sample of CKMS stream
+type prometheusQuantileSample struct {
+	value float64
+	width float64
+	delta float64
+}
+
+// prometheusQuantileStream estimates targeted quantiles over a stream of values
+// using the CKMS algorithm (Cormode, Korn, Muthukrishnan, Srivastava:
+// "Effective Computation of Biased Quantiles over Data Streams").
+// It keeps a bounded number of samples that guarantee the configured error for each quantile.
+type prometheusQuantileStream struct {
+	objectives []PrometheusObjective
+	n          float64
+	samples    []prometheusQuantileSample
+	buffer     []float64
+}
+
+const prometheusQuantileBufferSize = 500
+
+func newPrometheusQuantileStream(objectives []PrometheusObjective) *prometheusQuantileStream {
+	return &prometheusQuantileStream{
+		objectives: objectives,
+		samples:    make([]prometheusQuantileSample, 0),
+		buffer:     make([]float64, 0, prometheusQuantileBufferSize),
+	}
+}
+
+func (c *prometheusQuantileStream) insert(value float64) {
+	c.buffer = append(c.buffer, value)
+	if len(c.buffer) == cap(c.buffer) {
+		c.flush()
+	}
+}
+
+func (c *prometheusQuantileStream) reset() {
+	c.n = 0
+	c.samples = c.samples[:0]
+	c.buffer = c.buffer[:0]
+}
+
+func (c *prometheusQuantileStream) query(quantile float64) float64 {
+	c.flush()
+	if len(c.samples) == 0 {
+		return math.NaN()
+	}
+
+	rank := math.Ceil(quantile * c.n)
+	rank += math.Ceil(c.invariant(rank) / 2)
+	previous := c.samples[0]
+	var r float64
+	for _, sample := range c.samples[1:] {
+		r += previous.width
+		if r+sample.width+sample.delta > rank {
+			return previous.value
+		}
+		previous = sample
+	}
+	return previous.value
+}
+
+// Maximum allowed error at the given rank for the targeted quantiles
+func (c *prometheusQuantileStream) invariant(rank float64) float64 {
+	result := math.MaxFloat64
+	for _, objective := range c.objectives {
+		var f float64
+		if objective.Quantile*c.n <= rank {
+			f = (2 * objective.Error * rank) / objective.Quantile
+		} else {
+			f = (2 * objective.Error * (c.n - rank)) / (1 - objective.Quantile)
+		}
+		if f < result {
+			result = f
+		}
+	}
+	return result
+}
+
+func (c *prometheusQuantileStream) flush() {
+	if len(c.buffer) == 0 {
+		return
+	}
+	sort.Float64s(c.buffer)
+	c.merge(c.buffer)
+	c.buffer = c.buffer[:0]
+	c.compress()
+}
+
+func (c *prometheusQuantileStream) merge(values []float64) {
+	var r float64
+	index := 0
+	for _, value := range values {
+		inserted := false
+		for ; index < len(c.samples); index++ {
+			current := c.samples[index]
+			if current.value > value {
+				c.samples = append(c.samples, prometheusQuantileSample{})
+				copy(c.samples[index+1:], c.samples[index:])
+				c.samples[index] = prometheusQuantileSample{
+					value: value,
+					width: 1,
+					delta: math.Max(0, math.Floor(c.invariant(r))-1),
+				}
+				index++
+				inserted = true
+				break
+			}
+			r += current.width
+		}
+		if !inserted {
+			c.samples = append(c.samples, prometheusQuantileSample{value: value, width: 1})
+			index++
+		}
+		c.n++
+		r++
+	}
+}
+
+func (c *prometheusQuantileStream) compress() {
+	if len(c.samples) < 2 {
+		return
+	}
+
+	last := c.samples[len(c.samples)-1]
+	lastIndex := len(c.samples) - 1
+	r := c.n - 1 - last.width
+
+	for index := len(c.samples) - 2; index >= 0; index-- {
+		current := c.samples[index]
+		if current.width+last.width+last.delta <= c.invariant(r) {
+			last.width += current.width
+			c.samples[lastIndex] = last
+			c.samples = append(c.samples[:index], c.samples[index+1:]...)
+			lastIndex--
+		} else {
+			last = current
+			lastIndex = index
+		}
+		r -= current.width
+	}
+}
@@ -0,0 +1,85 @@
+package count
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+)
+
+// prometheusSeries is a counter recorded with an explicit set of labels.
+// Unlike counters kept by CachedCounters series are not reset by timeout,
+// they are kept until they are cleared.
+type prometheusSeries struct {
+	labels    []PrometheusLabel
+	counter   *ccount.AtomicCounter
+	total     *prometheusTotal
+	histogram *prometheusHistogram
+	summary   *prometheusSummary
+	native    *prometheusNativeHistogram
+	updated   time.Time
+}
+
+// Creates a series of the counter with specified name, type and sorted labels
+func newPrometheusSeries(name string, typ ccount.CounterType, labels []PrometheusLabel) *prometheusSeries {
+	return &prometheusSeries{
+		labels:  labels,
+		counter: ccount.NewAtomicCounter(name, typ),
+		total:   &prometheusTotal{created: time.Now()},
+	}
+}
+
+// Takes a snapshot of the series
+func (c *prometheusSeries) snapshot() *PrometheusCounterSnapshot {
+	snapshot := NewPrometheusCounterSnapshot(c.counter.GetCounter())
+	snapshot.Labels = make([]PrometheusLabel, len(c.labels))
+	copy(snapshot.Labels, c.labels)
+	snapshot.Updated = c.updated
+
+	switch snapshot.Type {
+	case ccount.Increment:
+		snapshot.Total = c.total.value
+		snapshot.Created = c.total.created
+		snapshot.Exemplar = c.total.exemplar
+	case ccount.Interval, ccount.Statistics:
+		snapshot.Created = c.total.created
+		if c.histogram != nil {
+			snapshot.Histogram = c.histogram.snapshot()
+		}
+		if c.summary != nil {
+			snapshot.Summary = c.summary.snapshot()
+		}
+		if c.native != nil {
+			snapshot.NativeHistogram = c.native.snapshot()
+		}
+	}
+	return snapshot
+}
+
+// Creates a key of the series with specified name and sorted labels
+func prometheusSeriesKey(name string, labels []PrometheusLabel) string {
+	return name + "\xff" + prometheusLabelsSignature(labels)
+}
+
+// Converts a map of labels into a list sorted by label names
+func prometheusLabelsFromMap(labels map[string]string) []PrometheusLabel {
+	result := make([]PrometheusLabel, 0, len(labels))
+	for name, value := range labels {
+		result = append(result, PrometheusLabel{Name: name, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// prometheusLabeledTiming passes the elapsed time of a timing to the labeled series
+type prometheusLabeledTiming struct {
+	counters *PrometheusCounters
+	labels   map[string]string
+}
+
+func (c *prometheusLabeledTiming) EndTiming(ctx context.Context, name string, elapsed float64) {
+	c.counters.EndTimingWithLabels(ctx, name, c.labels, elapsed)
+}
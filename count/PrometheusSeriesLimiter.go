@@ -0,0 +1,245 @@
+package count
+
+import (
+	"math"
+	"time"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+)
+
+const (
+	// PrometheusSeriesOverflowDrop drops series over the limit.
+	PrometheusSeriesOverflowDrop = "drop"
+	// PrometheusSeriesOverflowFold folds series over the limit into one series with "other" label values.
+	PrometheusSeriesOverflowFold = "fold"
+
+	// PrometheusSeriesOverflowCounter is a name of the counter that shows how many distinct series were rejected by limits.
+	PrometheusSeriesOverflowCounter = "prometheus.series_overflow"
+	// PrometheusSeriesOverflowValue is a label value of series folded over the limit.
+	PrometheusSeriesOverflowValue = "other"
+)
+
+// prometheusSeriesLimiter restricts the number of series exposed per metric family and in total.
+// Series are admitted in order they are written and once admitted they stay until they are released
+// or the limiter is reset, so the exposed series don't jump between scrapes.
+type prometheusSeriesLimiter struct {
+	maxSeries       int
+	maxFamilySeries int
+	overflow        string
+	admitted        map[string]map[string]bool
+	total           int
+	rejected        map[string]bool
+	overflows       map[string]*prometheusTotal
+	reported        map[string]bool
+}
+
+func newPrometheusSeriesLimiter() *prometheusSeriesLimiter {
+	c := &prometheusSeriesLimiter{
+		overflow: PrometheusSeriesOverflowDrop,
+	}
+	c.reset()
+	return c
+}
+
+// Reads limits from options.max_series, options.max_family_series and options.series_overflow
+func (c *prometheusSeriesLimiter) configure(config *cconf.ConfigParams) error {
+	c.maxSeries = config.GetAsIntegerWithDefault("options.max_series", c.maxSeries)
+	c.maxFamilySeries = config.GetAsIntegerWithDefault("options.max_family_series", c.maxFamilySeries)
+
+	overflow := config.GetAsStringWithDefault("options.series_overflow", c.overflow)
+	if overflow != PrometheusSeriesOverflowDrop && overflow != PrometheusSeriesOverflowFold {
+		return cerr.NewConfigError("", "INVALID_SERIES_OVERFLOW", "Series overflow shall be drop or fold").
+			WithDetails("series_overflow", overflow)
+	}
+	c.overflow = overflow
+	return nil
+}
+
+func (c *prometheusSeriesLimiter) enabled() bool {
+	return c.maxSeries > 0 || c.maxFamilySeries > 0
+}
+
+// Forgets admitted series and overflow statistics
+func (c *prometheusSeriesLimiter) reset() {
+	c.admitted = make(map[string]map[string]bool)
+	c.total = 0
+	c.rejected = make(map[string]bool)
+	c.overflows = make(map[string]*prometheusTotal)
+	c.reported = make(map[string]bool)
+}
+
+// Checks if the series fits into the limits and admits it
+//	Parameters:
+//		- family     a metric family name
+//		- signature  a signature of the series labels
+// Returns true if the series is admitted or false if it is over the limit
+func (c *prometheusSeriesLimiter) admit(family string, signature string) bool {
+	series, ok := c.admitted[family]
+	if ok && series[signature] {
+		return true
+	}
+	if c.maxSeries > 0 && c.total >= c.maxSeries {
+		return false
+	}
+	if c.maxFamilySeries > 0 && len(series) >= c.maxFamilySeries {
+		return false
+	}
+
+	if !ok {
+		series = make(map[string]bool)
+		c.admitted[family] = series
+	}
+	series[signature] = true
+	c.total++
+	return true
+}
+
+// Frees the place taken by the series that was removed
+//	Parameters:
+//		- family     a metric family name
+//		- signature  a signature of the series labels
+func (c *prometheusSeriesLimiter) release(family string, signature string) {
+	if series, ok := c.admitted[family]; ok && series[signature] {
+		delete(series, signature)
+		c.total--
+	}
+}
+
+// Counts the rejected series. Each series is counted once no matter how many times it is written.
+//	Parameters:
+//		- family     a metric family name
+//		- signature  a signature of the series labels
+// Returns true if it is the first overflow of the family
+func (c *prometheusSeriesLimiter) reject(family string, signature string) bool {
+	overflow, ok := c.overflows[family]
+	if !ok {
+		overflow = &prometheusTotal{created: time.Now()}
+		c.overflows[family] = overflow
+	}
+	if key := family + "\xff" + signature; !c.rejected[key] {
+		c.rejected[key] = true
+		overflow.value++
+	}
+
+	if c.reported[family] {
+		return false
+	}
+	c.reported[family] = true
+	return true
+}
+
+// Creates snapshots of the self-metric with numbers of rejected series per family
+func (c *prometheusSeriesLimiter) overflowSnapshots() []*PrometheusCounterSnapshot {
+	snapshots := make([]*PrometheusCounterSnapshot, 0, len(c.overflows))
+	for family, overflow := range c.overflows {
+		snapshots = append(snapshots, &PrometheusCounterSnapshot{
+			Counter: ccount.Counter{Name: PrometheusSeriesOverflowCounter, Type: ccount.Increment, Count: overflow.value},
+			Labels:  []PrometheusLabel{{Name: "family", Value: family}},
+			Total:   overflow.value,
+			Created: overflow.created,
+		})
+	}
+	return snapshots
+}
+
+// Replaces values of the series labels with "other" to fold series over the limit when they are written
+func foldPrometheusLabels(labels []PrometheusLabel) []PrometheusLabel {
+	folded := make([]PrometheusLabel, len(labels))
+	for index, label := range labels {
+		folded[index] = PrometheusLabel{Name: label.Name, Value: PrometheusSeriesOverflowValue}
+	}
+	return folded
+}
+
+// Creates a snapshot that folds series over the limit.
+// All labels except source, instance and constant labels get "other" value.
+func newPrometheusFoldedSnapshot(family string, typ ccount.CounterType, labels []PrometheusLabel,
+	constLabels []PrometheusLabel) *PrometheusCounterSnapshot {
+	folded := make([]PrometheusLabel, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == "source" || label.Name == "instance" || hasPrometheusLabelValue(constLabels, label) {
+			continue
+		}
+		folded = append(folded, PrometheusLabel{Name: label.Name, Value: PrometheusSeriesOverflowValue})
+	}
+	return &PrometheusCounterSnapshot{
+		Counter: ccount.Counter{Name: family, Type: typ, Min: math.NaN(), Max: math.NaN()},
+		Labels:  folded,
+		folded:  true,
+	}
+}
+
+// Adds measurements of the snapshot to the folded snapshot.
+// Counts, totals and histograms with the same buckets are added up, min and max are combined
+// and averages are weighted by counts. Summaries and native histograms can't be combined and are dropped.
+//	Parameters:
+//		- target  a folded snapshot
+//		- source  a snapshot of the series over the limit
+//		- first   true if it is the first series added to the folded snapshot
+func mergePrometheusSnapshot(target *PrometheusCounterSnapshot, source *PrometheusCounterSnapshot, first bool) {
+	if source.Time.After(target.Time) {
+		target.Time = source.Time
+		target.Last = source.Last
+	}
+	if source.Count > 0 {
+		if target.Count+source.Count > 0 {
+			target.Average = (target.Average*float64(target.Count) + source.Average*float64(source.Count)) /
+				float64(target.Count+source.Count)
+		}
+		if math.IsNaN(target.Min) || source.Min < target.Min {
+			target.Min = source.Min
+		}
+		if math.IsNaN(target.Max) || source.Max > target.Max {
+			target.Max = source.Max
+		}
+	}
+	target.Count += source.Count
+	target.Total += source.Total
+	if source.Exemplar != nil && (target.Exemplar == nil || source.Exemplar.Timestamp.After(target.Exemplar.Timestamp)) {
+		target.Exemplar = source.Exemplar
+	}
+	if !source.Created.IsZero() && (target.Created.IsZero() || source.Created.Before(target.Created)) {
+		target.Created = source.Created
+	}
+
+	target.Histogram = mergePrometheusHistogramSnapshot(target.Histogram, source.Histogram, first)
+}
+
+func mergePrometheusHistogramSnapshot(target *PrometheusHistogramSnapshot, source *PrometheusHistogramSnapshot, first bool) *PrometheusHistogramSnapshot {
+	if source == nil {
+		return nil
+	}
+	if first {
+		result := *source
+		result.Buckets = make([]PrometheusBucket, len(source.Buckets))
+		copy(result.Buckets, source.Buckets)
+		return &result
+	}
+	if target == nil || len(target.Buckets) != len(source.Buckets) {
+		return nil
+	}
+
+	for index := range target.Buckets {
+		if target.Buckets[index].UpperBound != source.Buckets[index].UpperBound {
+			return nil
+		}
+		target.Buckets[index].CumulativeCount += source.Buckets[index].CumulativeCount
+	}
+	target.Count += source.Count
+	target.Sum += source.Sum
+	if source.Created.Before(target.Created) {
+		target.Created = source.Created
+	}
+	return target
+}
+
+func hasPrometheusLabelValue(labels []PrometheusLabel, label PrometheusLabel) bool {
+	for _, existing := range labels {
+		if existing == label {
+			return true
+		}
+	}
+	return false
+}
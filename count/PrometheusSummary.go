@@ -0,0 +1,225 @@
+package count
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cconv "github.com/pip-services3-gox/pip-services3-commons-gox/convert"
+)
+
+// PrometheusObjective is a quantile with an allowed absolute error of its estimation.
+type PrometheusObjective struct {
+	Quantile float64 `json:"quantile"`
+	Error    float64 `json:"error"`
+}
+
+// DefaultPrometheusSummaryObjectives are quantiles estimated by summaries when objectives are not configured.
+var DefaultPrometheusSummaryObjectives = []PrometheusObjective{
+	{Quantile: 0.5, Error: 0.05},
+	{Quantile: 0.9, Error: 0.01},
+	{Quantile: 0.99, Error: 0.001},
+}
+
+const (
+	// DefaultPrometheusSummaryMaxAge is a default duration of the window in milliseconds that summary quantiles describe.
+	DefaultPrometheusSummaryMaxAge int64 = 600000
+	// DefaultPrometheusSummaryAgeBuckets is a default number of buckets the summary window is rotated by.
+	DefaultPrometheusSummaryAgeBuckets = 5
+)
+
+// PrometheusQuantile is an estimated value of a quantile.
+type PrometheusQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// PrometheusSummarySnapshot is a state of a summary recorded for Interval or Statistics counter.
+// Quantiles describe values observed within the sliding window, while Count and Sum are cumulative.
+type PrometheusSummarySnapshot struct {
+	Quantiles []PrometheusQuantile `json:"quantiles"`
+	Count     uint64               `json:"count"`
+	Sum       float64              `json:"sum"`
+	Created   time.Time            `json:"created"`
+}
+
+// prometheusSummary estimates quantiles over a sliding window of max age.
+// The window is represented by several streams that receive all observations
+// and are reset in rotation, so the head stream always covers from max age minus
+// one age bucket to max age of the most recent observations.
+type prometheusSummary struct {
+	lock           sync.Mutex
+	objectives     []PrometheusObjective
+	streams        []*prometheusQuantileStream
+	head           int
+	headExpires    time.Time
+	streamDuration time.Duration
+	count          uint64
+	sum            float64
+	created        time.Time
+}
+
+func newPrometheusSummary(objectives []PrometheusObjective, maxAge time.Duration, ageBuckets int) *prometheusSummary {
+	if ageBuckets < 1 {
+		ageBuckets = 1
+	}
+
+	now := time.Now()
+	c := &prometheusSummary{
+		objectives:     objectives,
+		streams:        make([]*prometheusQuantileStream, ageBuckets),
+		streamDuration: maxAge / time.Duration(ageBuckets),
+		created:        now,
+	}
+	for index := range c.streams {
+		c.streams[index] = newPrometheusQuantileStream(objectives)
+	}
+	c.headExpires = now.Add(c.streamDuration)
+	return c
+}
+
+func (c *prometheusSummary) observe(value float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rotate(time.Now())
+	for _, stream := range c.streams {
+		stream.insert(value)
+	}
+	c.count++
+	c.sum += value
+}
+
+func (c *prometheusSummary) snapshot() *PrometheusSummarySnapshot {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rotate(time.Now())
+	quantiles := make([]PrometheusQuantile, len(c.objectives))
+	for index, objective := range c.objectives {
+		quantiles[index] = PrometheusQuantile{
+			Quantile: objective.Quantile,
+			Value:    c.streams[c.head].query(objective.Quantile),
+		}
+	}
+
+	return &PrometheusSummarySnapshot{
+		Quantiles: quantiles,
+		Count:     c.count,
+		Sum:       c.sum,
+		Created:   c.created,
+	}
+}
+
+// Resets expired streams and moves the head to the next oldest one
+func (c *prometheusSummary) rotate(now time.Time) {
+	if c.streamDuration <= 0 {
+		return
+	}
+	for !now.Before(c.headExpires) {
+		c.streams[c.head].reset()
+		c.head = (c.head + 1) % len(c.streams)
+		c.headExpires = c.headExpires.Add(c.streamDuration)
+	}
+}
+
+// prometheusObjectivesRule assigns summary objectives to counters which names match a pattern
+type prometheusObjectivesRule struct {
+	regex      *regexp.Regexp
+	objectives []PrometheusObjective
+}
+
+// prometheusSummaryOptions defines what counters are recorded as summaries and how
+type prometheusSummaryOptions struct {
+	enabled    bool
+	objectives []PrometheusObjective
+	maxAge     int64
+	ageBuckets int
+	rules      []*prometheusObjectivesRule
+}
+
+func newPrometheusSummaryOptions() *prometheusSummaryOptions {
+	return &prometheusSummaryOptions{
+		enabled:    false,
+		objectives: DefaultPrometheusSummaryObjectives,
+		maxAge:     DefaultPrometheusSummaryMaxAge,
+		ageBuckets: DefaultPrometheusSummaryAgeBuckets,
+		rules:      make([]*prometheusObjectivesRule, 0),
+	}
+}
+
+// Reads summary options from options.summaries and summary sections
+func (c *prometheusSummaryOptions) configure(config *cconf.ConfigParams) error {
+	c.enabled = config.GetAsBooleanWithDefault("options.summaries", c.enabled)
+	if value := config.GetAsString("summary.objectives"); value != "" {
+		c.objectives = parsePrometheusObjectives(value)
+	}
+	c.maxAge = config.GetAsLongWithDefault("summary.max_age", c.maxAge)
+	c.ageBuckets = config.GetAsIntegerWithDefault("summary.age_buckets", c.ageBuckets)
+
+	section := config.GetSection("summary.rules")
+	names := sortConfigSectionNames(section.GetSectionNames())
+	if len(names) == 0 {
+		return nil
+	}
+
+	rules := make([]*prometheusObjectivesRule, 0, len(names))
+	for _, name := range names {
+		ruleConfig := section.GetSection(name)
+		expression, _ := compilePrometheusPattern(ruleConfig.GetAsString("pattern"))
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return err
+		}
+		objectives := c.objectives
+		if value := ruleConfig.GetAsString("objectives"); value != "" {
+			objectives = parsePrometheusObjectives(value)
+		}
+		rules = append(rules, &prometheusObjectivesRule{regex: regex, objectives: objectives})
+	}
+	c.rules = rules
+	return nil
+}
+
+// Creates a summary for the counter or nil if the counter shall not be recorded as summary
+func (c *prometheusSummaryOptions) summaryFor(name string) *prometheusSummary {
+	var objectives []PrometheusObjective
+	for _, rule := range c.rules {
+		if rule.regex.MatchString(name) {
+			objectives = rule.objectives
+			break
+		}
+	}
+	if objectives == nil && c.enabled {
+		objectives = c.objectives
+	}
+	if objectives == nil {
+		return nil
+	}
+	return newPrometheusSummary(objectives, time.Duration(c.maxAge)*time.Millisecond, c.ageBuckets)
+}
+
+// Parses comma-separated list of objectives in <quantile>:<error> format, i.e. 0.5:0.05,0.99:0.001
+func parsePrometheusObjectives(value string) []PrometheusObjective {
+	objectives := make([]PrometheusObjective, 0)
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		quantile, ok := cconv.DoubleConverter.ToNullableDouble(parts[0])
+		if !ok || quantile < 0 || quantile > 1 {
+			continue
+		}
+		objective := PrometheusObjective{Quantile: quantile, Error: 0.01}
+		if len(parts) > 1 {
+			objective.Error = cconv.DoubleConverter.ToDoubleWithDefault(parts[1], objective.Error)
+		}
+		objectives = append(objectives, objective)
+	}
+
+	sort.SliceStable(objectives, func(i, j int) bool {
+		return objectives[i].Quantile < objectives[j].Quantile
+	})
+	return objectives
+}
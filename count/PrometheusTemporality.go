@@ -0,0 +1,55 @@
+package count
+
+import (
+	"math"
+	"time"
+
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+)
+
+const (
+	// PrometheusDeltaTemporality exposes values kept by CachedCounters that are reset after reset timeout.
+	PrometheusDeltaTemporality = "delta"
+	// PrometheusCumulativeTemporality exposes values accumulated since counters were created.
+	PrometheusCumulativeTemporality = "cumulative"
+)
+
+// prometheusStats are statistics of Interval or Statistics counter accumulated
+// since the counter was created. They are kept in cumulative temporality.
+type prometheusStats struct {
+	typ     ccount.CounterType
+	count   int64
+	sum     float64
+	min     float64
+	max     float64
+	created time.Time
+}
+
+func newPrometheusStats(typ ccount.CounterType) *prometheusStats {
+	return &prometheusStats{
+		typ:     typ,
+		min:     math.MaxFloat64,
+		max:     -math.MaxFloat64,
+		created: time.Now(),
+	}
+}
+
+func (c *prometheusStats) observe(value float64) {
+	c.count++
+	c.sum += value
+	c.min = math.Min(c.min, value)
+	c.max = math.Max(c.max, value)
+}
+
+// Replaces values of the snapshot with the accumulated statistics
+func (c *prometheusStats) fill(snapshot *PrometheusCounterSnapshot) {
+	snapshot.Count = c.count
+	snapshot.Sum = c.sum
+	snapshot.Min = c.min
+	snapshot.Max = c.max
+	snapshot.Average = 0
+	if c.count > 0 {
+		snapshot.Average = c.sum / float64(c.count)
+	}
+	snapshot.Created = c.created
+}
@@ -0,0 +1,227 @@
+package count
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// prometheusTextWriter streams text expositions into a buffered writer.
+// Writers are pooled and keep scratch buffers for values and rendered labels,
+// so samples are written without allocation of intermediate strings.
+type prometheusTextWriter struct {
+	*bufio.Writer
+	// scratch is a buffer to format values
+	scratch []byte
+	// labels are rendered labels of the current metric shared by all its samples
+	labels []byte
+}
+
+var prometheusTextWriterPool = sync.Pool{
+	New: func() any {
+		return &prometheusTextWriter{
+			Writer:  bufio.NewWriterSize(nil, 32*1024),
+			scratch: make([]byte, 0, 64),
+			labels:  make([]byte, 0, 256),
+		}
+	},
+}
+
+// Takes a writer from the pool and points it to the output
+func acquirePrometheusTextWriter(output io.Writer) *prometheusTextWriter {
+	writer := prometheusTextWriterPool.Get().(*prometheusTextWriter)
+	writer.Reset(output)
+	return writer
+}
+
+// Flushes buffered output and returns the writer to the pool
+func releasePrometheusTextWriter(writer *prometheusTextWriter) error {
+	err := writer.Flush()
+	writer.Reset(nil)
+	prometheusTextWriterPool.Put(writer)
+	return err
+}
+
+// Writes metric families in the classic Prometheus text exposition format 0.0.4
+//	Parameters:
+//		- writer    a writer to write to
+//		- families  metric families to write
+func writeTextFamilies(writer *prometheusTextWriter, families []*PrometheusMetricFamily) {
+	for _, family := range families {
+		suffix := ""
+		if family.Type == PrometheusTypeCounter {
+			suffix = "_total"
+		}
+
+		if family.Help != "" {
+			writer.WriteString("# HELP ")
+			writer.WriteString(family.Name)
+			writer.WriteString(suffix)
+			writer.WriteByte(' ')
+			writer.WriteString(PrometheusNameSanitizer.EscapeHelp(family.Help))
+			writer.WriteByte('\n')
+		}
+		writer.WriteString("# TYPE ")
+		writer.WriteString(family.Name)
+		writer.WriteString(suffix)
+		writer.WriteByte(' ')
+		writer.WriteString(string(family.Type))
+		writer.WriteByte('\n')
+
+		for _, metric := range family.Metrics {
+			writer.setLabels(metric.Labels)
+			switch family.Type {
+			case PrometheusTypeHistogram:
+				writer.writeHistogramSamples(family.Name, metric, false)
+			case PrometheusTypeSummary:
+				writer.writeSummarySamples(family.Name, metric)
+			default:
+				writer.writeSample(family.Name, suffix, metric.Value)
+			}
+		}
+	}
+}
+
+// Writes buckets, sum and count of histogram. Exemplars of buckets are written only when they are supported.
+func (c *prometheusTextWriter) writeHistogramSamples(name string, metric *PrometheusMetric, exemplars bool) {
+	for _, bucket := range metric.Buckets {
+		exemplar := bucket.Exemplar
+		if !exemplars {
+			exemplar = nil
+		}
+		c.writeLabeledSample(name, "_bucket", "le", bucket.UpperBound, float64(bucket.CumulativeCount), exemplar)
+	}
+	exemplar := metric.Exemplar
+	if !exemplars {
+		exemplar = nil
+	}
+	c.writeLabeledSample(name, "_bucket", "le", math.Inf(1), float64(metric.Count), exemplar)
+	c.writeSample(name, "_sum", metric.Sum)
+	c.writeSample(name, "_count", float64(metric.Count))
+}
+
+func (c *prometheusTextWriter) writeSummarySamples(name string, metric *PrometheusMetric) {
+	for _, quantile := range metric.Quantiles {
+		c.writeLabeledSample(name, "", "quantile", quantile.Quantile, quantile.Value, nil)
+	}
+	c.writeSample(name, "_sum", metric.Sum)
+	c.writeSample(name, "_count", float64(metric.Count))
+}
+
+// Renders labels of a metric, they are reused by all samples of the metric
+func (c *prometheusTextWriter) setLabels(labels []PrometheusLabel) {
+	c.labels = c.labels[:0]
+	for index, label := range labels {
+		if index > 0 {
+			c.labels = append(c.labels, ',')
+		}
+		c.labels = append(c.labels, label.Name...)
+		c.labels = append(c.labels, '=', '"')
+		c.labels = appendPrometheusLabelValue(c.labels, label.Value)
+		c.labels = append(c.labels, '"')
+	}
+}
+
+// Writes a sample with labels of the current metric
+func (c *prometheusTextWriter) writeSample(name string, suffix string, value float64) {
+	c.WriteString(name)
+	c.WriteString(suffix)
+	if len(c.labels) > 0 {
+		c.WriteByte('{')
+		c.Write(c.labels)
+		c.WriteByte('}')
+	}
+	c.WriteByte(' ')
+	c.writeValue(value)
+	c.WriteByte('\n')
+}
+
+// Writes a sample with labels of the current metric and an extra numeric label, i.e. le or quantile,
+// followed by OpenMetrics exemplar, i.e. # {trace_id="abc"} 0.5 1520879607.789
+func (c *prometheusTextWriter) writeLabeledSample(name string, suffix string, label string, labelValue float64,
+	value float64, exemplar *PrometheusExemplar) {
+	c.WriteString(name)
+	c.WriteString(suffix)
+	c.WriteByte('{')
+	if len(c.labels) > 0 {
+		c.Write(c.labels)
+		c.WriteByte(',')
+	}
+	c.WriteString(label)
+	c.WriteString("=\"")
+	c.writeValue(labelValue)
+	c.WriteString("\"} ")
+	c.writeValue(value)
+	c.writeExemplar(exemplar)
+	c.WriteByte('\n')
+}
+
+// Writes a sample with labels of the current metric followed by OpenMetrics exemplar
+func (c *prometheusTextWriter) writeExemplarSample(name string, suffix string, value float64, exemplar *PrometheusExemplar) {
+	c.WriteString(name)
+	c.WriteString(suffix)
+	if len(c.labels) > 0 {
+		c.WriteByte('{')
+		c.Write(c.labels)
+		c.WriteByte('}')
+	}
+	c.WriteByte(' ')
+	c.writeValue(value)
+	c.writeExemplar(exemplar)
+	c.WriteByte('\n')
+}
+
+func (c *prometheusTextWriter) writeExemplar(exemplar *PrometheusExemplar) {
+	if exemplar == nil {
+		return
+	}
+
+	c.WriteString(" # {")
+	for index, label := range exemplar.Labels {
+		if index > 0 {
+			c.WriteByte(',')
+		}
+		c.WriteString(label.Name)
+		c.WriteString("=\"")
+		c.scratch = appendPrometheusLabelValue(c.scratch[:0], label.Value)
+		c.Write(c.scratch)
+		c.WriteByte('"')
+	}
+	c.WriteString("} ")
+	c.writeValue(exemplar.Value)
+	if !exemplar.Timestamp.IsZero() {
+		c.WriteByte(' ')
+		c.scratch = strconv.AppendFloat(c.scratch[:0], float64(exemplar.Timestamp.UnixNano())/1e9, 'f', 3, 64)
+		c.Write(c.scratch)
+	}
+}
+
+func (c *prometheusTextWriter) writeValue(value float64) {
+	c.scratch = appendPrometheusValue(c.scratch[:0], value)
+	c.Write(c.scratch)
+}
+
+// Appends an escaped label value. Values that need no escaping are appended as they are.
+func appendPrometheusLabelValue(buffer []byte, value string) []byte {
+	if !strings.ContainsAny(value, "\\\"\n") && utf8.ValidString(value) {
+		return append(buffer, value...)
+	}
+	return append(buffer, PrometheusNameSanitizer.EscapeLabelValue(value)...)
+}
+
+func appendPrometheusValue(buffer []byte, value float64) []byte {
+	switch {
+	case math.IsNaN(value):
+		return append(buffer, "NaN"...)
+	case math.IsInf(value, 1):
+		return append(buffer, "+Inf"...)
+	case math.IsInf(value, -1):
+		return append(buffer, "-Inf"...)
+	default:
+		return strconv.AppendFloat(buffer, value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,88 @@
+package count
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+
+	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
+	cauth "github.com/pip-services3-gox/pip-services3-components-gox/auth"
+)
+
+// prometheusTlsOptions are TLS settings of connections to PushGateway
+type prometheusTlsOptions struct {
+	serverName string
+	minVersion string
+}
+
+// Creates TLS configuration from CA bundle, client certificate and key files of the credential.
+// Returns nil configuration when no TLS settings are set, so the default transport is used.
+func (c *prometheusTlsOptions) tlsConfig(correlationId string, credential *cauth.CredentialParams) (*tls.Config, error) {
+	caFile, crtFile, keyFile := "", "", ""
+	if credential != nil {
+		caFile = credential.GetAsString("ssl_ca_file")
+		crtFile = credential.GetAsString("ssl_crt_file")
+		keyFile = credential.GetAsString("ssl_key_file")
+	}
+	if caFile == "" && crtFile == "" && keyFile == "" && c.serverName == "" && c.minVersion == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: c.serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.minVersion != "" {
+		version, ok := parsePrometheusTlsVersion(c.minVersion)
+		if !ok {
+			return nil, cerr.NewConfigError(correlationId, "INVALID_TLS_VERSION", "Minimum TLS version shall be 1.0, 1.1, 1.2 or 1.3").
+				WithDetails("version", c.minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, cerr.NewConnectionError(correlationId, "CANNOT_READ_CA_FILE", "Failed to read CA certificates").
+				WithDetails("file", caFile).WithCause(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, cerr.NewConnectionError(correlationId, "INVALID_CA_FILE", "CA file has no valid PEM certificates").
+				WithDetails("file", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if crtFile != "" || keyFile != "" {
+		if crtFile == "" || keyFile == "" {
+			return nil, cerr.NewConnectionError(correlationId, "NO_CLIENT_CERTIFICATE", "Client certificate requires both ssl_crt_file and ssl_key_file").
+				WithDetails("crt_file", crtFile).WithDetails("key_file", keyFile)
+		}
+		certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
+		if err != nil {
+			return nil, cerr.NewConnectionError(correlationId, "INVALID_CLIENT_CERTIFICATE", "Failed to load client certificate and key").
+				WithDetails("crt_file", crtFile).WithDetails("key_file", keyFile).WithCause(err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+func parsePrometheusTlsVersion(version string) (uint16, bool) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, true
+	case "1.1", "11":
+		return tls.VersionTLS11, true
+	case "1.2", "12":
+		return tls.VersionTLS12, true
+	case "1.3", "13":
+		return tls.VersionTLS13, true
+	}
+	return 0, false
+}
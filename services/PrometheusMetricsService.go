@@ -1,10 +1,13 @@
 package services
 
 import (
+	"bytes"
 	"context"
-	"io"
 	"net/http"
+	"strings"
+	"time"
 
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
 	cref "github.com/pip-services3-gox/pip-services3-commons-gox/refer"
 	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
 	cinfo "github.com/pip-services3-gox/pip-services3-components-gox/info"
@@ -25,6 +28,44 @@ import (
 //			- host:                  host name or IP address
 //			- port:                  port number
 //			- uri:                   resource URI or connection string with all parameters in it
+//		- mapping:
+//			- rules:
+//				- <index>:
+//					- pattern:           a template where * matches one name segment, i.e. *.*.calls
+//					- regex:             (optional) a regular expression used instead of the template
+//					- name:              a metric name, i.e. calls_total
+//					- labels:            comma-separated label names for matched segments, i.e. service,command
+//		- metadata:
+//			- <counter>:                 a counter name or a template where * matches one name segment, i.e. *.*.calls
+//				- help:              a description of metrics of the counter shown in HELP lines
+//				- unit:              (optional) a unit of metrics, shown in OpenMetrics for names ending with _<unit>
+//				- type:              (optional) type of Increment, LastValue and Timestamp counters: counter, gauge or untyped
+//		- options:
+//			- native_counters:       expose Increment counters as cumulative Prometheus counters with _total suffix (default: false)
+//			- temporality:           cumulative or delta (default: temporality of PrometheusCounters or delta)
+//			- series_ttl:            time in milliseconds after which counters that are not updated are not exposed, 0 to expose all (default: 0)
+//			- timestamp_age:         expose age of Timestamp counters as <name>_age_seconds gauges (default: false)
+//			- namespace:             (optional) a prefix of all metric names, i.e. acme
+//			- subsystem:             (optional) a prefix of all metric names after the namespace, i.e. billing
+//			- debug:                 validate text and OpenMetrics responses and log found problems as warnings (default: false)
+//		- labels:
+//			- <name>:                a constant label added to all series, i.e. labels.env=prod
+//
+// The exposition format is negotiated by Accept header or requested by name in ?format= parameter.
+// Besides Prometheus exposition formats the service returns a JSON list of counters with their names, types,
+// labels and values when it is requested by ?format=json parameter or by Accept: application/json header.
+//
+// In debug mode responses are buffered and checked by Validate before they are sent,
+// so it is meant for development and tests rather than for production scrapes.
+//
+// Mapping rules, constant labels, namespace, subsystem and options of metric names and values
+// that are not configured in the service are taken from the referenced PrometheusCounters,
+// so scrapes expose the same metrics as pushes.
+//
+// Metadata that is not configured in the service is taken from the referenced PrometheusCounters.
+//
+// The time of the last update is known only for counters kept by PrometheusCounters,
+// so series_ttl is not applied to counters taken from CachedCounters.
 //
 //	References:
 //
@@ -33,6 +74,7 @@ import (
 //		- *:discovery:*:*:1.0        (optional)  IDiscovery services to resolve connection
 //		- *:endpoint:http:*:1.0          (optional)  HttpEndpoint reference to expose REST operation
 //		- *:counters:prometheus:*:1.0    PrometheusCounters reference to retrieve collected metrics
+//		- *:prometheus-formatter:*:*:1.0 (optional)  IPrometheusFormatter components that replace or add exposition formats
 //
 // See RestService
 // See RestClient
@@ -54,9 +96,14 @@ import (
 //
 type PrometheusMetricsService struct {
 	rpcservices.RestService
-	cachedCounters *ccount.CachedCounters
-	source         string
-	instance       string
+	cachedCounters     *ccount.CachedCounters
+	prometheusCounters *pcount.PrometheusCounters
+	converter          *pcount.TPrometheusCounterConverter
+	config             *cconf.ConfigParams
+	source             string
+	instance           string
+	seriesTtl          int64
+	debug              bool
 }
 
 // NewPrometheusMetricsService are creates a new instance of c service.
@@ -65,11 +112,26 @@ type PrometheusMetricsService struct {
 func NewPrometheusMetricsService() *PrometheusMetricsService {
 	c := &PrometheusMetricsService{}
 	c.RestService = *rpcservices.InheritRestService(c)
+	c.converter = pcount.NewPrometheusCounterConverter()
+	c.config = cconf.NewEmptyConfigParams()
 	c.DependencyResolver.Put(context.Background(), "cached-counters", cref.NewDescriptor("pip-services", "counters", "cached", "*", "1.0"))
 	c.DependencyResolver.Put(context.Background(), "prometheus-counters", cref.NewDescriptor("pip-services", "counters", "prometheus", "*", "1.0"))
 	return c
 }
 
+// Configure method are configures component by passing configuration parameters.
+//	Parameters:
+//		- ctx context.Context	operation context
+//		- config   *cconf.ConfigParams
+// configuration parameters to be set.
+func (c *PrometheusMetricsService) Configure(ctx context.Context, config *cconf.ConfigParams) {
+	c.RestService.Configure(ctx, config)
+	c.converter.Configure(ctx, config)
+	c.config = config
+	c.seriesTtl = config.GetAsLongWithDefault("options.series_ttl", c.seriesTtl)
+	c.debug = config.GetAsBooleanWithDefault("options.debug", c.debug)
+}
+
 // SetReferences is sets references to dependent components.
 //	Parameters:
 //		- ctx context.Context	operation context
@@ -77,16 +139,19 @@ func NewPrometheusMetricsService() *PrometheusMetricsService {
 // references to locate the component dependencies.
 func (c *PrometheusMetricsService) SetReferences(ctx context.Context, references cref.IReferences) {
 	c.RestService.SetReferences(ctx, references)
+	c.converter.SetReferences(ctx, references)
 
-	resolv := c.DependencyResolver.GetOneOptional("prometheus-counters")
-	c.cachedCounters = resolv.(*pcount.PrometheusCounters).CachedCounters
-	if c.cachedCounters == nil {
-		resolv = c.DependencyResolver.GetOneOptional("cached-counters")
-		c.cachedCounters = resolv.(*ccount.CachedCounters)
+	if counters, ok := c.DependencyResolver.GetOneOptional("prometheus-counters").(*pcount.PrometheusCounters); ok {
+		c.prometheusCounters = counters
+		c.cachedCounters = counters.CachedCounters
+		c.inheritConverter(counters.Converter())
+		c.converter.Metadata().SetFallback(counters.Metadata())
+	} else if counters, ok := c.DependencyResolver.GetOneOptional("cached-counters").(*ccount.CachedCounters); ok {
+		c.cachedCounters = counters
 	}
 	ref := references.GetOneOptional(
 		cref.NewDescriptor("pip-services", "context-info", "default", "*", "1.0"))
-	contextInfo := ref.(*cinfo.ContextInfo)
+	contextInfo, _ := ref.(*cinfo.ContextInfo)
 
 	if contextInfo != nil && c.source == "" {
 		c.source = contextInfo.Name
@@ -96,29 +161,130 @@ func (c *PrometheusMetricsService) SetReferences(ctx context.Context, references
 	}
 }
 
+// Takes settings of the converter that are not configured in the service from the converter
+// of PrometheusCounters, so scrapes expose the same metrics as pushes
+func (c *PrometheusMetricsService) inheritConverter(converter *pcount.TPrometheusCounterConverter) {
+	if !c.config.Contains("options.native_counters") {
+		c.converter.SetNativeCounters(converter.NativeCounters())
+	}
+	if !c.config.Contains("options.timestamp_age") {
+		c.converter.SetTimestampAge(converter.TimestampAge())
+	}
+	if !c.config.Contains("options.temporality") {
+		c.converter.SetTemporality(converter.Temporality())
+	}
+
+	namespace, subsystem := c.converter.Namespace(), c.converter.Subsystem()
+	if !c.config.Contains("options.namespace") {
+		namespace = converter.Namespace()
+	}
+	if !c.config.Contains("options.subsystem") {
+		subsystem = converter.Subsystem()
+	}
+	c.converter.SetNamespace(namespace, subsystem)
+
+	if c.config.GetSection("labels").Len() == 0 {
+		labels := make(map[string]string)
+		for _, label := range converter.ConstLabels() {
+			labels[label.Name] = label.Value
+		}
+		c.converter.SetConstLabels(labels)
+	}
+	if len(c.config.GetSection("mapping.rules").GetSectionNames()) == 0 {
+		c.converter.SetMappingRules(converter.MappingRules())
+	}
+}
+
 // Register method are registers all service routes in HTTP endpoint.
 func (c *PrometheusMetricsService) Register() {
 	c.RegisterRoute("get", "metrics", nil, func(res http.ResponseWriter, req *http.Request) { c.metrics(res, req) })
 }
 
 // Handles metrics requests
+// The exposition format is negotiated with the scraper by Accept header:
+// OpenMetrics 1.0, delimited protobuf or a format of referenced formatter is returned when it is requested,
+// otherwise the classic text format 0.0.4 is used. The format parameter selects a formatter by its name.
+// The JSON view of counters is returned for ?format=json parameter or when application/json is preferred by Accept header.
 //	Parameters:
 //		- req   an HTTP request
 //		- res   an HTTP response
 func (c *PrometheusMetricsService) metrics(res http.ResponseWriter, req *http.Request) {
 
-	var atomicCounters []*ccount.AtomicCounter
-	if c.cachedCounters != nil {
-		atomicCounters = c.cachedCounters.GetAll()
+	var snapshots []*pcount.PrometheusCounterSnapshot
+	if c.prometheusCounters != nil {
+		snapshots = c.prometheusCounters.GetSnapshots()
+	} else if c.cachedCounters != nil {
+		snapshots = pcount.NewPrometheusCounterSnapshots(c.cachedCounters.GetAllCountersStats())
+	}
+	if c.seriesTtl > 0 {
+		snapshots = c.liveSnapshots(snapshots)
+	}
+
+	formatter := c.formatter(req)
+	if snapshotFormatter, ok := formatter.(pcount.IPrometheusSnapshotFormatter); ok {
+		res.Header().Add("content-type", formatter.ContentType())
+		res.WriteHeader(200)
+		if err := snapshotFormatter.WriteSnapshots(res, snapshots); err != nil {
+			c.Logger.Error(req.Context(), "PrometheusMetricsService", err, "Can't write response")
+		}
+		return
 	}
 
-	counters := pcount.PrometheusCounterConverter.AtomicCountersToCounters(atomicCounters)
-	body := pcount.PrometheusCounterConverter.ToString(counters, c.source, c.instance)
+	families := c.converter.SnapshotsToFamilies(snapshots, c.source, c.instance)
+
+	format := formatter.Format()
+	if c.debug && (format == pcount.PrometheusTextFormat || format == pcount.PrometheusOpenMetricsFormat) {
+		c.validatedMetrics(res, req, formatter, families)
+		return
+	}
 
-	res.Header().Add("content-type", "text/plain")
+	// Metrics are streamed straight into the response
+	res.Header().Add("content-type", formatter.ContentType())
 	res.WriteHeader(200)
-	_, wrErr := io.WriteString(res, (string)(body))
-	if wrErr != nil {
-		c.Logger.Error(req.Context(), "PrometheusMetricsService", wrErr, "Can't write response")
+	if err := formatter.Write(res, families); err != nil {
+		c.Logger.Error(req.Context(), "PrometheusMetricsService", err, "Can't write response")
+	}
+}
+
+// Writes metrics into a buffer, logs problems found in the exposition and sends it
+func (c *PrometheusMetricsService) validatedMetrics(res http.ResponseWriter, req *http.Request,
+	formatter pcount.IPrometheusFormatter, families []*pcount.PrometheusMetricFamily) {
+	buffer := bytes.Buffer{}
+	if err := formatter.Write(&buffer, families); err != nil {
+		c.Logger.Error(req.Context(), "PrometheusMetricsService", err, "Can't write response")
+	}
+	for _, problem := range pcount.ValidateFormat(formatter.Format(), buffer.Bytes()) {
+		c.Logger.Warn(req.Context(), "PrometheusMetricsService", "Invalid %s exposition: %s", formatter.Format(), problem.Error())
+	}
+
+	res.Header().Add("content-type", formatter.ContentType())
+	res.WriteHeader(200)
+	if _, err := res.Write(buffer.Bytes()); err != nil {
+		c.Logger.Error(req.Context(), "PrometheusMetricsService", err, "Can't write response")
+	}
+}
+
+// Filters out snapshots of counters that were not updated within the TTL
+func (c *PrometheusMetricsService) liveSnapshots(snapshots []*pcount.PrometheusCounterSnapshot) []*pcount.PrometheusCounterSnapshot {
+	deadline := time.Now().Add(-time.Duration(c.seriesTtl) * time.Millisecond)
+
+	result := make([]*pcount.PrometheusCounterSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot.Updated.IsZero() || !snapshot.Updated.Before(deadline) {
+			result = append(result, snapshot)
+		}
+	}
+	return result
+}
+
+// Selects a formatter by format parameter or negotiates it by Accept header
+func (c *PrometheusMetricsService) formatter(req *http.Request) pcount.IPrometheusFormatter {
+	if format := strings.ToLower(req.URL.Query().Get("format")); format != "" {
+		for _, formatter := range c.converter.Formatters() {
+			if formatter.Format() == format {
+				return formatter
+			}
+		}
 	}
+	return c.converter.NegotiateFormatter(req.Header.Get("Accept"))
 }
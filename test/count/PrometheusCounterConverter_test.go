@@ -0,0 +1,431 @@
+package test_count
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cref "github.com/pip-services3-gox/pip-services3-commons-gox/refer"
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+	pcount "github.com/pip-services3-gox/pip-services3-prometheus-gox/count"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusCounterConverterEmpty(t *testing.T) {
+	body := pcount.PrometheusCounterConverter.ToString([]ccount.Counter{}, "", "")
+	assert.Equal(t, "", body)
+
+	body = pcount.PrometheusCounterConverter.ToOpenMetricsString([]ccount.Counter{}, "", "")
+	assert.Equal(t, "# EOF\n", body)
+}
+
+func TestPrometheusCounterConverterText(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "MyService.MyCommand.exec_time", Type: ccount.Interval, Min: 1, Max: 3, Average: 2, Count: 2},
+		{Name: "Test.LastValue", Type: ccount.LastValue, Last: 123},
+	}
+
+	body := pcount.PrometheusCounterConverter.ToString(counters, "MyApp", "MyInstance")
+	assert.True(t, strings.Contains(body, "# TYPE exec_time_max gauge\n"))
+	assert.True(t, strings.Contains(body,
+		`exec_time_max{command="MyCommand",instance="MyInstance",service="MyService",source="MyApp"} 3`+"\n"))
+	assert.True(t, strings.Contains(body, "# TYPE test_lastvalue gauge\n"))
+	assert.True(t, strings.Contains(body, `test_lastvalue{instance="MyInstance",source="MyApp"} 123`+"\n"))
+	assert.False(t, strings.Contains(body, "# EOF"))
+}
+
+func TestPrometheusCounterConverterFamilies(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "svc_b.cmd.exec_time", Type: ccount.Interval, Min: 1, Max: 1, Average: 1, Count: 1},
+		{Name: "svc_a.cmd.exec_time", Type: ccount.Interval, Min: 2, Max: 2, Average: 2, Count: 1},
+	}
+
+	body := pcount.PrometheusCounterConverter.ToString(counters, "", "")
+	assert.Equal(t, 1, strings.Count(body, "# TYPE exec_time_max gauge\n"))
+	assert.True(t, strings.Contains(body, "# TYPE exec_time_max gauge\n"+
+		`exec_time_max{command="cmd",service="svc_a"} 2`+"\n"+
+		`exec_time_max{command="cmd",service="svc_b"} 1`+"\n"))
+
+	// The output does not depend on the order of counters
+	reversed := []ccount.Counter{counters[1], counters[0]}
+	assert.Equal(t, body, pcount.PrometheusCounterConverter.ToString(reversed, "", ""))
+}
+
+func TestPrometheusCounterConverterCollisions(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "test/value", Type: ccount.LastValue, Last: 2},
+		{Name: "test.value", Type: ccount.LastValue, Last: 1},
+	}
+
+	families := pcount.PrometheusCounterConverter.ToFamilies(counters, "", "")
+	assert.Len(t, families, 1)
+	assert.Len(t, families[0].Metrics, 1)
+	assert.Equal(t, float64(1), families[0].Metrics[0].Value)
+}
+
+func TestPrometheusCounterConverterSampleNameCollisions(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"options.temporality", "cumulative",
+	))
+
+	snapshots := []*pcount.PrometheusCounterSnapshot{
+		{Counter: ccount.Counter{Name: "requests", Type: ccount.Increment, Count: 2}, Total: 5},
+		{Counter: ccount.Counter{Name: "requests_total", Type: ccount.LastValue, Last: 1}},
+		{Counter: ccount.Counter{Name: "latency", Type: ccount.Interval, Count: 2, Min: 1, Max: 3}, Sum: 4},
+		{Counter: ccount.Counter{Name: "latency_count", Type: ccount.LastValue, Last: 1}},
+		{Counter: ccount.Counter{Name: "latency_sum", Type: ccount.LastValue, Last: 1}},
+		{Counter: ccount.Counter{Name: "requests_created", Type: ccount.LastValue, Last: 1}},
+	}
+	families := converter.SnapshotsToFamilies(snapshots, "", "")
+
+	names := make([]string, 0)
+	for _, family := range families {
+		names = append(names, family.Name)
+	}
+	assert.Equal(t, []string{"latency", "latency_max", "latency_min", "requests"}, names)
+
+	body := string(converter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.Equal(t, 1, strings.Count(body, "# TYPE requests_total "))
+	assert.Equal(t, 1, strings.Count(body, "\nrequests_total "))
+}
+
+func TestPrometheusCounterConverterEscaping(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "9users/by-name.count", Type: ccount.LastValue, Last: 1},
+		{Name: "my\"svc.get\nitems.exec_time", Type: ccount.Interval, Count: 1},
+	}
+
+	body := pcount.PrometheusCounterConverter.ToString(counters, "", "")
+	assert.True(t, strings.Contains(body, "# TYPE _9users_by_name_count gauge\n_9users_by_name_count 1\n"))
+	assert.True(t, strings.Contains(body, `exec_time_count{command="get\nitems",service="my\"svc"} 1`+"\n"))
+}
+
+func TestPrometheusCounterConverterOpenMetrics(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "Test.Increment", Type: ccount.Increment, Count: 4},
+	}
+
+	body := pcount.PrometheusCounterConverter.ToOpenMetricsString(counters, "", "")
+	assert.Equal(t, "# TYPE test_increment gauge\ntest_increment 4\n# EOF\n", body)
+}
+
+func TestPrometheusCounterConverterNativeCounters(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"options.native_counters", true,
+	))
+
+	created := time.Unix(1500000000, 500000000)
+	snapshots := []*pcount.PrometheusCounterSnapshot{
+		{Counter: ccount.Counter{Name: "test.calls", Type: ccount.Increment, Count: 2}, Total: 5, Created: created},
+		{Counter: ccount.Counter{Name: "test.errors_total", Type: ccount.Increment, Count: 1}, Total: 1},
+	}
+	families := converter.SnapshotsToFamilies(snapshots, "", "")
+
+	body := string(converter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.Equal(t, "# TYPE test_calls_total counter\ntest_calls_total 5\n"+
+		"# TYPE test_errors_total counter\ntest_errors_total 1\n", body)
+
+	body = string(converter.FormatFamilies(pcount.PrometheusOpenMetricsFormat, families))
+	assert.Equal(t, "# TYPE test_calls counter\ntest_calls_total 5\ntest_calls_created 1.5000000005e+09\n"+
+		"# TYPE test_errors counter\ntest_errors_total 1\n# EOF\n", body)
+}
+
+func TestPrometheusCounterConverterConstLabels(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"labels.env", "prod",
+		"labels.region", "eu-west-1",
+		"labels.source", "ignored",
+		"options.namespace", "acme",
+		"options.subsystem", "billing",
+	))
+
+	counters := []ccount.Counter{
+		{Name: "MyService.MyCommand.exec_time", Type: ccount.Interval, Min: 1, Max: 3, Average: 2, Count: 2},
+		{Name: "Test.LastValue", Type: ccount.LastValue, Last: 123},
+	}
+
+	body := string(converter.ToFormat(pcount.PrometheusTextFormat, counters, "MyApp", ""))
+	assert.True(t, strings.Contains(body, "# TYPE acme_billing_exec_time_max gauge\n"))
+	assert.True(t, strings.Contains(body,
+		`acme_billing_exec_time_max{command="MyCommand",env="prod",region="eu-west-1",service="MyService",source="MyApp"} 3`+"\n"))
+	assert.True(t, strings.Contains(body, `acme_billing_test_lastvalue{env="prod",region="eu-west-1",source="MyApp"} 123`+"\n"))
+
+	converter.SetNamespace("", "billing")
+	converter.SetConstLabels(map[string]string{})
+	body = string(converter.ToFormat(pcount.PrometheusTextFormat, counters, "", ""))
+	assert.True(t, strings.Contains(body, "billing_test_lastvalue 123\n"))
+}
+
+func TestPrometheusCounterConverterMetadata(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"metadata.test.calls.help", "Number of calls",
+		"metadata.test.calls.type", "counter",
+		"metadata.*.*.exec_time.help", "Execution time",
+		"metadata.test.memory_bytes.help", "Used memory",
+		"metadata.test.memory_bytes.unit", "bytes",
+		"metadata.test.value.type", "untyped",
+	))
+
+	counters := []ccount.Counter{
+		{Name: "test.calls", Type: ccount.Increment, Count: 2},
+		{Name: "svc.cmd.exec_time", Type: ccount.Interval, Min: 1, Max: 3, Average: 2, Count: 2},
+		{Name: "test.memory_bytes", Type: ccount.LastValue, Last: 1024},
+		{Name: "test.value", Type: ccount.LastValue, Last: 1},
+	}
+
+	body := string(converter.ToFormat(pcount.PrometheusTextFormat, counters, "", ""))
+	assert.True(t, strings.Contains(body, "# HELP test_calls_total Number of calls\n# TYPE test_calls_total counter\ntest_calls_total 2\n"))
+	assert.True(t, strings.Contains(body, "# HELP exec_time_max Execution time\n# TYPE exec_time_max gauge\n"))
+	assert.True(t, strings.Contains(body, "# TYPE test_value untyped\n"))
+
+	body = string(converter.ToFormat(pcount.PrometheusOpenMetricsFormat, counters, "", ""))
+	assert.True(t, strings.Contains(body, "# TYPE test_memory_bytes gauge\n# UNIT test_memory_bytes bytes\n# HELP test_memory_bytes Used memory\n"))
+	assert.True(t, strings.Contains(body, "# TYPE test_value unknown\n"))
+
+	body = string(converter.ToFormat(pcount.PrometheusProtobufFormat, counters, "", ""))
+	assert.True(t, strings.Contains(body, "Number of calls"))
+
+	// Exact names take precedence over templates
+	registry := converter.Metadata()
+	assert.Nil(t, registry.Register("**", pcount.PrometheusMetadata{Help: "Any counter"}))
+	metadata, ok := registry.Find("test.calls")
+	assert.True(t, ok)
+	assert.Equal(t, "Number of calls", metadata.Help)
+	metadata, ok = registry.Find("other")
+	assert.True(t, ok)
+	assert.Equal(t, "Any counter", metadata.Help)
+
+	err := registry.Register("test.calls", pcount.PrometheusMetadata{Type: pcount.PrometheusTypeHistogram})
+	assert.NotNil(t, err)
+
+	fallback := pcount.NewPrometheusMetadataRegistry()
+	fallback.Register("test.*", pcount.PrometheusMetadata{Help: "Test counter"})
+	registry.Clear()
+	registry.SetFallback(fallback)
+	metadata, ok = registry.Find("test.other")
+	assert.True(t, ok)
+	assert.Equal(t, "Test counter", metadata.Help)
+}
+
+func TestPrometheusCounterConverterMetadataOverlap(t *testing.T) {
+	// Configured templates are checked from the most specific ones
+	registry := pcount.NewPrometheusMetadataRegistry()
+	err := registry.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"metadata.orders.**.help", "Order counter",
+		"metadata.orders.*.calls.help", "Order calls",
+		"metadata.*.*.calls.help", "Calls",
+	))
+	assert.Nil(t, err)
+
+	metadata, ok := registry.Find("orders.create.calls")
+	assert.True(t, ok)
+	assert.Equal(t, "Order calls", metadata.Help)
+	metadata, ok = registry.Find("orders.create.exec_time")
+	assert.True(t, ok)
+	assert.Equal(t, "Order counter", metadata.Help)
+	metadata, ok = registry.Find("users.create.calls")
+	assert.True(t, ok)
+	assert.Equal(t, "Calls", metadata.Help)
+
+	// Registered templates are checked in the order they were registered
+	registry = pcount.NewPrometheusMetadataRegistry()
+	assert.Nil(t, registry.Register("orders.**", pcount.PrometheusMetadata{Help: "Order counter"}))
+	assert.Nil(t, registry.Register("orders.*.calls", pcount.PrometheusMetadata{Help: "Order calls"}))
+	metadata, ok = registry.Find("orders.create.calls")
+	assert.True(t, ok)
+	assert.Equal(t, "Order counter", metadata.Help)
+}
+
+func TestNegotiatePrometheusFormat(t *testing.T) {
+	assert.Equal(t, pcount.PrometheusTextFormat, pcount.NegotiatePrometheusFormat(""))
+	assert.Equal(t, pcount.PrometheusTextFormat, pcount.NegotiatePrometheusFormat("text/plain"))
+	assert.Equal(t, pcount.PrometheusOpenMetricsFormat,
+		pcount.NegotiatePrometheusFormat("application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"))
+	assert.Equal(t, pcount.PrometheusTextFormat,
+		pcount.NegotiatePrometheusFormat("application/openmetrics-text;version=0.0.1,text/plain;version=0.0.4;q=0.5"))
+	assert.Equal(t, pcount.PrometheusTextFormat,
+		pcount.NegotiatePrometheusFormat("application/openmetrics-text;q=0.3,text/plain;q=0.5"))
+	assert.Equal(t, pcount.PrometheusProtobufFormat,
+		pcount.NegotiatePrometheusFormat("application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3"))
+}
+
+func TestPrometheusCounterConverterProtobuf(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "a", Type: ccount.LastValue, Last: 1},
+	}
+
+	body := pcount.PrometheusCounterConverter.ToProtobuf(counters, "", "")
+	expected := []byte{
+		0x12,            // message length
+		0x0a, 0x01, 'a', // name
+		0x18, 0x01, // type GAUGE
+		0x22, 0x0b, // metric
+		0x12, 0x09, // gauge
+		0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, // value 1.0
+	}
+	assert.Equal(t, expected, body)
+}
+
+type csvPrometheusFormatter struct{}
+
+func (c *csvPrometheusFormatter) Format() string      { return "csv" }
+func (c *csvPrometheusFormatter) ContentType() string { return "text/csv" }
+func (c *csvPrometheusFormatter) Accepts(mediaType string, params map[string]string) bool {
+	return mediaType == "text/csv"
+}
+func (c *csvPrometheusFormatter) Write(writer io.Writer, families []*pcount.PrometheusMetricFamily) error {
+	for _, family := range families {
+		for _, metric := range family.Metrics {
+			if _, err := fmt.Fprintf(writer, "%s,%g\n", family.Name, metric.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestPrometheusCounterConverterFormatters(t *testing.T) {
+	ctx := context.Background()
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.SetReferences(ctx, cref.NewReferencesFromTuples(ctx,
+		cref.NewDescriptor("test", "prometheus-formatter", "csv", "default", "1.0"), &csvPrometheusFormatter{},
+	))
+
+	assert.Len(t, converter.Formatters(), 5)
+	assert.Equal(t, "csv", converter.NegotiateFormatter("text/csv;q=0.9,application/xml").Format())
+	assert.Equal(t, pcount.PrometheusJsonFormat, converter.NegotiateFormatter("text/csv;q=0.9,application/json").Format())
+	assert.Equal(t, pcount.PrometheusTextFormat, converter.NegotiateFormatter("application/xml").Format())
+	assert.Equal(t, pcount.PrometheusOpenMetricsContentType, converter.Formatter(pcount.PrometheusOpenMetricsFormat).ContentType())
+	assert.Equal(t, pcount.PrometheusTextFormat, converter.Formatter("unknown").Format())
+
+	counters := []ccount.Counter{{Name: "Test.LastValue", Type: ccount.LastValue, Last: 123}}
+	body := string(converter.ToFormat("csv", counters, "", ""))
+	assert.Equal(t, "test_lastvalue,123\n", body)
+}
+
+func TestPrometheusCounterConverterJson(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	counters := []ccount.Counter{
+		{Name: "test.calls", Type: ccount.Increment, Count: 2},
+		{Name: "test.value", Type: ccount.LastValue, Last: math.NaN()},
+		{Name: "test.limit", Type: ccount.LastValue, Last: math.Inf(1)},
+	}
+
+	body := converter.ToFormat(pcount.PrometheusJsonFormat, counters, "", "")
+	var families []map[string]any
+	err := json.Unmarshal(body, &families)
+	assert.Nil(t, err)
+	assert.Len(t, families, 3)
+	metric := func(index int) map[string]any {
+		return families[index]["metrics"].([]any)[0].(map[string]any)
+	}
+	assert.Equal(t, "test_calls", families[0]["name"])
+	assert.Equal(t, "gauge", families[0]["type"])
+	assert.Equal(t, float64(2), metric(0)["value"])
+	assert.Equal(t, []any{}, metric(0)["labels"])
+	// Non-finite values are kept as strings
+	assert.Equal(t, "test_limit", families[1]["name"])
+	assert.Equal(t, "+Inf", metric(1)["value"])
+	assert.Equal(t, "test_value", families[2]["name"])
+	assert.Equal(t, "NaN", metric(2)["value"])
+	assert.Equal(t, pcount.PrometheusJsonContentType, pcount.PrometheusFormatContentType(pcount.PrometheusJsonFormat))
+}
+
+func TestPrometheusJsonFormatterSnapshots(t *testing.T) {
+	formatter := pcount.NewPrometheusJsonFormatter()
+	snapshots := []*pcount.PrometheusCounterSnapshot{
+		{Counter: ccount.Counter{Name: "test.value", Type: ccount.LastValue, Last: math.NaN()}},
+		{
+			Counter: ccount.Counter{Name: "test.exec_time", Type: ccount.Interval, Count: 2, Min: 1, Max: 3, Average: 2},
+			Labels:  []pcount.PrometheusLabel{{Name: "tenant", Value: "a"}},
+			Sum:     4,
+			Summary: &pcount.PrometheusSummarySnapshot{
+				Quantiles: []pcount.PrometheusQuantile{{Quantile: 0.5, Value: math.NaN()}},
+			},
+		},
+	}
+
+	buffer := bytes.Buffer{}
+	err := formatter.WriteSnapshots(&buffer, snapshots)
+	assert.Nil(t, err)
+
+	var counters []map[string]any
+	err = json.Unmarshal(buffer.Bytes(), &counters)
+	assert.Nil(t, err)
+	assert.Len(t, counters, 2)
+	assert.Equal(t, "test.exec_time", counters[0]["name"])
+	assert.Equal(t, "interval", counters[0]["type"])
+	assert.Equal(t, float64(1), counters[0]["min"])
+	assert.Equal(t, float64(3), counters[0]["max"])
+	assert.Equal(t, float64(2), counters[0]["average"])
+	assert.Equal(t, float64(4), counters[0]["sum"])
+	assert.Equal(t, []any{map[string]any{"name": "tenant", "value": "a"}}, counters[0]["labels"])
+	quantiles := counters[0]["summary"].(map[string]any)["quantiles"].([]any)
+	assert.Equal(t, "NaN", quantiles[0].(map[string]any)["value"])
+	assert.Equal(t, "test.value", counters[1]["name"])
+	assert.Equal(t, "lastvalue", counters[1]["type"])
+	assert.Equal(t, "NaN", counters[1]["last"])
+	assert.Equal(t, []any{}, counters[1]["labels"])
+}
+
+func benchmarkPrometheusCounters() []ccount.Counter {
+	counters := make([]ccount.Counter, 0, 4000)
+	for index := 0; index < 1000; index++ {
+		service := fmt.Sprintf("service%d", index%20)
+		command := fmt.Sprintf("command%d", index)
+		counters = append(counters,
+			ccount.Counter{Name: service + "." + command + ".exec_time", Type: ccount.Interval, Min: 1, Max: 3, Average: 2, Count: 2},
+			ccount.Counter{Name: service + "." + command + ".calls", Type: ccount.Increment, Count: int64(index)},
+			ccount.Counter{Name: service + "." + command + ".last", Type: ccount.LastValue, Last: float64(index)},
+			ccount.Counter{Name: service + "." + command + ".time", Type: ccount.Timestamp, Time: time.Now()},
+		)
+	}
+	return counters
+}
+
+func BenchmarkPrometheusCounterConverterToString(b *testing.B) {
+	counters := benchmarkPrometheusCounters()
+	converter := pcount.NewPrometheusCounterConverter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		_ = converter.ToString(counters, "app", "instance")
+	}
+}
+
+func BenchmarkPrometheusCounterConverterWriteTo(b *testing.B) {
+	counters := benchmarkPrometheusCounters()
+	converter := pcount.NewPrometheusCounterConverter()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		_ = converter.WriteTo(io.Discard, counters, "app", "instance")
+	}
+}
+
+func BenchmarkPrometheusFormatters(b *testing.B) {
+	converter := pcount.NewPrometheusCounterConverter()
+	families := converter.ToFamilies(benchmarkPrometheusCounters(), "app", "instance")
+
+	for _, formatter := range converter.Formatters() {
+		b.Run(formatter.Format(), func(b *testing.B) {
+			b.ReportAllocs()
+			for index := 0; index < b.N; index++ {
+				_ = formatter.Write(io.Discard, families)
+			}
+		})
+	}
+}
@@ -2,12 +2,33 @@ package test_count
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
+	cref "github.com/pip-services3-gox/pip-services3-commons-gox/refer"
+	cauth "github.com/pip-services3-gox/pip-services3-components-gox/auth"
 	pcount "github.com/pip-services3-gox/pip-services3-prometheus-gox/count"
 	pfixture "github.com/pip-services3-gox/pip-services3-prometheus-gox/test/fixture"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestPrometheusCounters(t *testing.T) {
@@ -40,3 +61,899 @@ func TestPrometheusCounters(t *testing.T) {
 	t.Run("Simple Counters", fixture.TestSimpleCounters)
 	t.Run("Measure Elapsed Time", fixture.TestMeasureElapsedTime)
 }
+
+func TestPrometheusCountersCumulativeTotals(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+
+	counters.IncrementOne(ctx, "test.calls")
+	counters.Increment(ctx, "test.calls", 2)
+
+	// Simulate reset of cached counters after reset_timeout
+	counters.CachedCounters.ClearAll(ctx)
+	counters.IncrementOne(ctx, "test.calls")
+
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, int64(1), snapshots[0].Count)
+	assert.Equal(t, int64(4), snapshots[0].Total)
+	assert.False(t, snapshots[0].Created.IsZero())
+
+	counters.ClearAll(ctx)
+	assert.Len(t, counters.GetSnapshots(), 0)
+}
+
+func TestPrometheusCountersHistograms(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"histogram.buckets", "10,100",
+		"histogram.rules.0.pattern", "*.*.exec_time",
+		"histogram.rules.0.buckets", "50,5,+Inf",
+		"histogram.rules.1.pattern", "test.stats",
+	))
+
+	counters.EndTiming(ctx, "svc.cmd.exec_time", 3)
+	counters.EndTiming(ctx, "svc.cmd.exec_time", 30)
+	counters.EndTiming(ctx, "svc.cmd.exec_time", 300)
+	counters.Stats(ctx, "test.stats", 20)
+	counters.Stats(ctx, "test.other", 20)
+
+	families := pcount.PrometheusCounterConverter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	body := string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+
+	assert.True(t, strings.Contains(body, "# TYPE exec_time histogram\n"+
+		`exec_time_bucket{command="cmd",service="svc",le="5"} 1`+"\n"+
+		`exec_time_bucket{command="cmd",service="svc",le="50"} 2`+"\n"+
+		`exec_time_bucket{command="cmd",service="svc",le="+Inf"} 3`+"\n"+
+		`exec_time_sum{command="cmd",service="svc"} 333`+"\n"+
+		`exec_time_count{command="cmd",service="svc"} 3`+"\n"))
+	assert.True(t, strings.Contains(body, "# TYPE test_stats histogram\n"+
+		`test_stats_bucket{le="10"} 0`+"\n"+
+		`test_stats_bucket{le="100"} 1`+"\n"))
+	assert.True(t, strings.Contains(body, "# TYPE test_other_average gauge\n"))
+}
+
+func TestPrometheusCountersSummaries(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.summaries", true,
+		"summary.objectives", "0.5:0.05,0.99:0.001",
+		"summary.max_age", 60000,
+		"summary.age_buckets", 3,
+	))
+
+	for value := 1; value <= 1000; value++ {
+		counters.Stats(ctx, "test.latency", float64(value))
+	}
+
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 1)
+	summary := snapshots[0].Summary
+	assert.NotNil(t, summary)
+	assert.Equal(t, uint64(1000), summary.Count)
+	assert.Equal(t, float64(500500), summary.Sum)
+	assert.Len(t, summary.Quantiles, 2)
+	assert.InDelta(t, 500, summary.Quantiles[0].Value, 50)
+	assert.InDelta(t, 990, summary.Quantiles[1].Value, 1)
+
+	families := pcount.PrometheusCounterConverter.SnapshotsToFamilies(snapshots, "", "")
+	body := string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.True(t, strings.HasPrefix(body, "# TYPE test_latency summary\ntest_latency{quantile=\"0.5\"} "))
+	assert.True(t, strings.Contains(body, "\ntest_latency_sum 500500\ntest_latency_count 1000\n"))
+	assert.False(t, strings.Contains(body, "test_latency_average"))
+}
+
+func TestPrometheusCountersNativeHistograms(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.native_histograms", true,
+		"native_histogram.schema", 0,
+	))
+
+	counters.Stats(ctx, "test.latency", 0)
+	counters.Stats(ctx, "test.latency", 1)
+	counters.Stats(ctx, "test.latency", 2)
+	counters.Stats(ctx, "test.latency", 4)
+	counters.Stats(ctx, "test.latency", 16)
+
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 1)
+	native := snapshots[0].NativeHistogram
+	assert.NotNil(t, native)
+	assert.Equal(t, int32(0), native.Schema)
+	assert.Equal(t, uint64(5), native.Count)
+	assert.Equal(t, float64(23), native.Sum)
+	assert.Equal(t, uint64(1), native.ZeroCount)
+	assert.Equal(t, []pcount.PrometheusBucketSpan{{Offset: 0, Length: 3}, {Offset: 1, Length: 1}}, native.PositiveSpans)
+	assert.Equal(t, []int64{1, 0, 0, 0}, native.PositiveDeltas)
+	assert.Len(t, native.NegativeSpans, 0)
+
+	families := pcount.PrometheusCounterConverter.SnapshotsToFamilies(snapshots, "", "")
+	assert.Len(t, families, 1)
+	assert.Equal(t, pcount.PrometheusTypeHistogram, families[0].Type)
+	assert.NotNil(t, families[0].Metrics[0].NativeHistogram)
+
+	body := string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.True(t, strings.Contains(body, "test_latency_sum 23\ntest_latency_count 5\n"))
+
+	buffer := pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusProtobufFormat, families)
+	assert.True(t, len(buffer) > 0)
+}
+
+func TestPrometheusCountersLabeledSeries(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"method": "GET", "route": "/users", "status": "200"}, 2)
+	counters.IncrementOneWithLabels(ctx, "http.requests", map[string]string{"status": "500", "route": "/users", "method": "POST"})
+	counters.IncrementOneWithLabels(ctx, "http.requests", map[string]string{"method": "GET", "route": "/users", "status": "200"})
+	counters.StatsWithLabels(ctx, "http.size", map[string]string{"method": "GET"}, 10)
+	counters.StatsWithLabels(ctx, "http.size", map[string]string{"method": "GET"}, 20)
+	timing := counters.BeginTimingWithLabels(ctx, "http.exec_time", map[string]string{"method": "GET"})
+	timing.EndTiming(ctx)
+
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 4)
+
+	families := pcount.PrometheusCounterConverter.SnapshotsToFamilies(snapshots, "", "")
+	body := string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.True(t, strings.Contains(body, "# TYPE http_requests gauge\n"+
+		"http_requests{method=\"GET\",route=\"/users\",status=\"200\"} 3\n"+
+		"http_requests{method=\"POST\",route=\"/users\",status=\"500\"} 1\n"))
+	assert.Equal(t, 1, strings.Count(body, "# TYPE http_requests gauge"))
+	assert.True(t, strings.Contains(body, "http_size_max{method=\"GET\"} 20\n"))
+	assert.True(t, strings.Contains(body, "http_exec_time_count{method=\"GET\"} 1\n"))
+
+	counters.Clear(ctx, "http.requests")
+	assert.Len(t, counters.GetSnapshots(), 2)
+	counters.ClearAll(ctx)
+	assert.Len(t, counters.GetSnapshots(), 0)
+}
+
+func TestPrometheusCountersSeriesLimits(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.max_family_series", 2,
+		"options.max_series", 3,
+	))
+
+	for _, user := range []string{"a", "b", "c", "d"} {
+		counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": user}, 1)
+	}
+	counters.IncrementOne(ctx, "test.calls")
+	counters.IncrementOne(ctx, "test.errors")
+
+	families := pcount.PrometheusCounterConverter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	body := string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.True(t, strings.Contains(body, "http_requests{user=\"a\"} 1\nhttp_requests{user=\"b\"} 1\n"))
+	assert.False(t, strings.Contains(body, "user=\"c\""))
+	assert.True(t, strings.Contains(body, "test_calls 1\n"))
+	assert.False(t, strings.Contains(body, "\ntest_errors "))
+	assert.True(t, strings.Contains(body, "prometheus_series_overflow{family=\"http_requests\"} 2\n"))
+	assert.True(t, strings.Contains(body, "prometheus_series_overflow{family=\"test_errors\"} 1\n"))
+
+	// Dropped counters are not kept
+	assert.Len(t, counters.GetAllCountersStats(), 1)
+
+	// Admitted series stay the same and each rejected series is counted once
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": "0"}, 1)
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": "c"}, 1)
+	counters.IncrementOne(ctx, "test.errors")
+	for scrape := 0; scrape < 2; scrape++ {
+		families = pcount.PrometheusCounterConverter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+		body = string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+		assert.True(t, strings.Contains(body, "http_requests{user=\"a\"} 1\nhttp_requests{user=\"b\"} 1\n"))
+		assert.False(t, strings.Contains(body, "user=\"0\""))
+		assert.True(t, strings.Contains(body, "prometheus_series_overflow{family=\"http_requests\"} 3\n"))
+		assert.True(t, strings.Contains(body, "prometheus_series_overflow{family=\"test_errors\"} 1\n"))
+	}
+
+	// Cleared series free their places
+	counters.Clear(ctx, "http.requests")
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": "0"}, 1)
+	families = pcount.PrometheusCounterConverter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	body = string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.True(t, strings.Contains(body, "http_requests{user=\"0\"} 1\n"))
+}
+
+func TestPrometheusCountersSeriesFolding(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.max_family_series", 1,
+		"options.series_overflow", "fold",
+	))
+
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": "a"}, 1)
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": "b"}, 2)
+	counters.IncrementWithLabels(ctx, "http.requests", map[string]string{"user": "c"}, 3)
+	counters.StatsWithLabels(ctx, "http.size", map[string]string{"user": "a"}, 10)
+	counters.StatsWithLabels(ctx, "http.size", map[string]string{"user": "b"}, 20)
+	counters.StatsWithLabels(ctx, "http.size", map[string]string{"user": "c"}, 40)
+
+	families := pcount.PrometheusCounterConverter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	body := string(pcount.PrometheusCounterConverter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.True(t, strings.Contains(body, "http_requests{user=\"a\"} 1\nhttp_requests{user=\"other\"} 5\n"))
+	assert.True(t, strings.Contains(body, "http_size_max{user=\"other\"} 40\n"))
+	assert.True(t, strings.Contains(body, "http_size_min{user=\"other\"} 20\n"))
+	assert.True(t, strings.Contains(body, "http_size_average{user=\"other\"} 30\n"))
+	assert.True(t, strings.Contains(body, "prometheus_series_overflow{family=\"http_requests\"} 2\n"))
+}
+
+func TestPrometheusCountersDump(t *testing.T) {
+	ctx := context.Background()
+
+	pushes := make(chan string, 5)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		pushes <- string(body)
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"source", "test",
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	defer counters.Close(ctx, "")
+
+	// Counters and labeled series are pushed once
+	counters.Last(ctx, "test.value", 3)
+	counters.LastWithLabels(ctx, "test.labeled", map[string]string{"tenant": "a"}, 1)
+	err = counters.Dump(ctx)
+	assert.Nil(t, err)
+	err = counters.Dump(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, pushes, 1)
+	body := <-pushes
+	assert.Contains(t, body, "test_value 3\n")
+	assert.Contains(t, body, "test_labeled{tenant=\"a\"} 1\n")
+
+	// Only labeled series were updated
+	counters.LastWithLabels(ctx, "test.labeled", map[string]string{"tenant": "a"}, 2)
+	err = counters.Dump(ctx)
+	assert.Nil(t, err)
+	err = counters.Dump(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, pushes, 1)
+	assert.Contains(t, <-pushes, "test_labeled{tenant=\"a\"} 2\n")
+}
+
+func TestPrometheusCountersExemplars(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.native_counters", true,
+		"options.histograms", true,
+		"histogram.buckets", "10,100",
+	))
+
+	counters.Increment(pcount.AddCorrelationIdToContext(ctx, "123"), "test.calls", 2)
+	counters.EndTimingWithTraceId(ctx, "test.exec_time", 50, "abc")
+	counters.EndTiming(ctx, "test.exec_time", 5)
+
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 2)
+	for _, snapshot := range snapshots {
+		if snapshot.Name == "test.calls" {
+			assert.NotNil(t, snapshot.Exemplar)
+			assert.Equal(t, []pcount.PrometheusLabel{{Name: "correlation_id", Value: "123"}}, snapshot.Exemplar.Labels)
+			assert.Equal(t, float64(2), snapshot.Exemplar.Value)
+		} else {
+			assert.Nil(t, snapshot.Histogram.Buckets[0].Exemplar)
+			assert.NotNil(t, snapshot.Histogram.Buckets[1].Exemplar)
+			assert.Equal(t, "abc", snapshot.Histogram.Buckets[1].Exemplar.Labels[0].Value)
+		}
+	}
+
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.SetNativeCounters(true)
+	families := converter.SnapshotsToFamilies(snapshots, "", "")
+	body := string(converter.FormatFamilies(pcount.PrometheusOpenMetricsFormat, families))
+	assert.True(t, strings.Contains(body, "test_calls_total 2 # {correlation_id=\"123\"} 2 "))
+	assert.True(t, strings.Contains(body, "test_exec_time_bucket{le=\"10\"} 1\n"))
+	assert.True(t, strings.Contains(body, "test_exec_time_bucket{le=\"100\"} 2 # {trace_id=\"abc\"} 50 "))
+
+	body = string(converter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.False(t, strings.Contains(body, "trace_id"))
+}
+
+func TestPrometheusCountersSeriesTtl(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.series_ttl", 100,
+		"options.max_series", 2,
+	))
+
+	counters.IncrementOne(ctx, "test.old")
+	counters.IncrementOneWithLabels(ctx, "test.labeled", map[string]string{"tenant": "a"})
+	time.Sleep(200 * time.Millisecond)
+
+	// Expired series are hidden, but reading doesn't remove them
+	assert.Len(t, counters.GetSnapshots(), 0)
+	assert.Len(t, counters.GetSnapshots(), 0)
+	assert.Len(t, counters.GetAllCountersStats(), 1)
+
+	// They are removed on dump
+	err := counters.Dump(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, counters.GetAllCountersStats(), 0)
+
+	counters.IncrementOne(ctx, "test.new")
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, "test.new", snapshots[0].Name)
+	assert.False(t, snapshots[0].Updated.IsZero())
+
+	counters.IncrementOneWithLabels(ctx, "test.labeled", map[string]string{"tenant": "b"})
+	assert.Len(t, counters.GetSnapshots(), 2)
+
+	// Expired series free their places under the limits when new series are written
+	time.Sleep(200 * time.Millisecond)
+	counters.IncrementOneWithLabels(ctx, "test.labeled", map[string]string{"tenant": "c"})
+	counters.IncrementOneWithLabels(ctx, "test.labeled", map[string]string{"tenant": "d"})
+	snapshots = counters.GetSnapshots()
+	assert.Len(t, snapshots, 2)
+	assert.Len(t, counters.GetAllCountersStats(), 0)
+}
+
+func TestPrometheusCountersTimestampAge(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+
+	counters.Timestamp(ctx, "test.started", time.Now().Add(-time.Minute))
+
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.timestamp_age", true,
+	))
+	families := converter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	assert.Len(t, families, 2)
+	assert.Equal(t, "test_started_age_seconds", families[1].Name)
+	assert.InDelta(t, 60, families[1].Metrics[0].Value, 1)
+}
+
+func TestPrometheusCountersPushFormat(t *testing.T) {
+	ctx := context.Background()
+
+	contentTypes := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		contentTypes <- req.Header.Get("Content-Type")
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"source", "test",
+		"options.push_format", "protobuf",
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	defer counters.Close(ctx, "")
+
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, pcount.PrometheusProtobufContentType, <-contentTypes)
+
+	// JSON can't be pushed, the previous format is kept
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.push_format", "json",
+	))
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, pcount.PrometheusProtobufContentType, <-contentTypes)
+}
+
+func TestPrometheusCountersTemporality(t *testing.T) {
+	ctx := context.Background()
+	config := cconf.NewConfigParamsFromTuples(
+		"reset_timeout", 50,
+		"options.temporality", "cumulative",
+	)
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, config)
+
+	counters.Stats(ctx, "test.value", 5)
+	counters.Increment(ctx, "test.calls", 2)
+	time.Sleep(100 * time.Millisecond)
+	counters.Stats(ctx, "test.value", 7)
+	counters.Increment(ctx, "test.calls", 1)
+
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(ctx, config)
+	assert.Equal(t, pcount.PrometheusCumulativeTemporality, converter.Temporality())
+
+	families := converter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	output := string(converter.FormatFamilies(pcount.PrometheusTextFormat, families))
+	assert.Contains(t, output, "# TYPE test_calls_total counter\n")
+	assert.Contains(t, output, "test_calls_total 3\n")
+	assert.Contains(t, output, "# TYPE test_value summary\n")
+	assert.Contains(t, output, "test_value_count 2\n")
+	assert.Contains(t, output, "test_value_sum 12\n")
+	assert.Contains(t, output, "test_value_max 7\n")
+	assert.Contains(t, output, "test_value_min 5\n")
+
+	openMetrics := string(converter.FormatFamilies(pcount.PrometheusOpenMetricsFormat, families))
+	assert.Contains(t, openMetrics, "test_calls_created ")
+	assert.Contains(t, openMetrics, "test_value_created ")
+
+	// ClearAll starts cumulative statistics over
+	cleared := time.Now()
+	counters.ClearAll(ctx)
+	counters.Stats(ctx, "test.value", 3)
+
+	snapshots := counters.GetSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, int64(1), snapshots[0].Count)
+	assert.Equal(t, float64(3), snapshots[0].Sum)
+	assert.Equal(t, float64(3), snapshots[0].Max)
+	assert.Equal(t, float64(3), snapshots[0].Min)
+	assert.False(t, snapshots[0].Created.Before(cleared))
+
+	// Delta temporality exposes values since the last reset
+	counters = pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples("reset_timeout", 50))
+
+	counters.Stats(ctx, "test.value", 5)
+	time.Sleep(100 * time.Millisecond)
+	counters.Stats(ctx, "test.value", 7)
+
+	snapshots = counters.GetSnapshots()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, int64(1), snapshots[0].Count)
+	assert.Equal(t, float64(7), snapshots[0].Max)
+	assert.Equal(t, float64(7), snapshots[0].Min)
+}
+
+func TestPrometheusCountersConstLabels(t *testing.T) {
+	ctx := context.Background()
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"labels.env", "prod",
+		"options.namespace", "acme",
+		"options.max_family_series", 1,
+		"options.series_overflow", "fold",
+	))
+
+	counters.IncrementWithLabels(ctx, "test.calls", map[string]string{"method": "get"}, 1)
+	counters.IncrementWithLabels(ctx, "test.calls", map[string]string{"method": "post"}, 2)
+
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"labels.env", "prod",
+		"options.namespace", "acme",
+	))
+	families := converter.SnapshotsToFamilies(counters.GetSnapshots(), "", "")
+	names := make([]string, 0)
+	for _, family := range families {
+		names = append(names, family.Name)
+		for _, metric := range family.Metrics {
+			assert.Contains(t, metric.Labels, pcount.PrometheusLabel{Name: "env", Value: "prod"})
+		}
+	}
+	assert.Equal(t, []string{"acme_prometheus_series_overflow", "acme_test_calls"}, names)
+	assert.Len(t, families[1].Metrics, 2)
+}
+
+func TestPrometheusCountersPushRetries(t *testing.T) {
+	ctx := context.Background()
+
+	attempts := 0
+	bodies := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// Drop the connection to make the client retry
+			conn, _, _ := res.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"source", "test",
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	defer counters.Close(ctx, "")
+
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Contains(t, <-bodies, "test_value 3\n")
+}
+
+func TestPrometheusCountersPushStatus(t *testing.T) {
+	ctx := context.Background()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(status)
+		if status >= 300 {
+			res.Write([]byte("invalid metric name\n"))
+		}
+	}))
+	defer server.Close()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"source", "test",
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	defer counters.Close(ctx, "")
+
+	counters.Last(ctx, "test.value", 3)
+	for _, status = range []int{http.StatusOK, http.StatusAccepted, http.StatusNoContent} {
+		err = counters.Save(ctx, counters.GetAllCountersStats())
+		assert.Nil(t, err)
+	}
+
+	for _, status = range []int{http.StatusBadRequest, http.StatusInternalServerError} {
+		err = counters.Save(ctx, counters.GetAllCountersStats())
+		assert.NotNil(t, err)
+		appErr, ok := err.(*cerr.ApplicationError)
+		assert.True(t, ok)
+		assert.Equal(t, "PUSH_FAILED", appErr.Code)
+		assert.Equal(t, status, appErr.Details["status"])
+		assert.Equal(t, "invalid metric name", appErr.Details["body"])
+	}
+}
+
+func TestPrometheusCountersPushMethodAndDelete(t *testing.T) {
+	ctx := context.Background()
+
+	requests := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests <- req.Method + " " + req.URL.Path
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"source", "test",
+		"instance", "worker1",
+		"options.push_method", "post",
+		"options.delete_on_close", true,
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, "POST /metrics/job/test/instance/worker1", <-requests)
+
+	err = counters.Close(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "DELETE /metrics/job/test/instance/worker1", <-requests)
+
+	// Invalid method is ignored and closing without delete_on_close leaves the group
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"options.push_method", "patch",
+		"options.delete_on_close", false,
+	))
+	err = counters.Open(ctx, "")
+	assert.Nil(t, err)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, "POST /metrics/job/test/instance/worker1", <-requests)
+	err = counters.Close(ctx, "")
+	assert.Nil(t, err)
+	assert.Len(t, requests, 0)
+}
+
+func TestPrometheusCountersGrouping(t *testing.T) {
+	ctx := context.Background()
+
+	requests := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests <- req.RequestURI
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"source", "test",
+		"grouping.job", "batch",
+		"grouping.instance", "node 1",
+		"grouping.tenant", "a/b",
+		"grouping.shard", "",
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	defer counters.Close(ctx, "")
+
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, "/metrics/job/batch/instance/node%201/shard@base64/=/tenant@base64/YS9i", <-requests)
+
+	// Reconfiguration replaces the grouping key
+	counters.Close(ctx, "")
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"instance", "node2",
+		"grouping.tenant", "acme",
+	))
+	err = counters.Open(ctx, "")
+	assert.Nil(t, err)
+
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, "/metrics/job/test/instance/node2/tenant/acme", <-requests)
+}
+
+func TestPrometheusCountersConnectionParams(t *testing.T) {
+	ctx := context.Background()
+
+	requests := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests <- req.Header.Get("Authorization")
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	address, _ := url.Parse(server.URL)
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.protocol", "http",
+		"connection.host", address.Hostname(),
+		"connection.port", address.Port(),
+		"credential.access_token", "token",
+	))
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token", <-requests)
+	counters.Close(ctx, "")
+
+	// Invalid connection fails to open the component
+	for _, config := range []*cconf.ConfigParams{
+		cconf.NewConfigParamsFromTuples("connection.protocol", "http", "connection.host", address.Hostname()),
+		cconf.NewConfigParamsFromTuples("connection.protocol", "ftp", "connection.host", address.Hostname(), "connection.port", address.Port()),
+	} {
+		counters = pcount.NewPrometheusCounters()
+		counters.Configure(ctx, config)
+		err = counters.Open(ctx, "")
+		if assert.NotNil(t, err) {
+			assert.Equal(t, cerr.Misconfiguration, err.(*cerr.ApplicationError).Category)
+		}
+		assert.False(t, counters.IsOpen())
+	}
+
+	// Without connection the component stays in passive mode
+	counters = pcount.NewPrometheusCounters()
+	err = counters.Open(ctx, "")
+	assert.Nil(t, err)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	counters.Close(ctx, "")
+}
+
+func TestPrometheusCountersCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		headers <- req.Header.Get("Authorization")
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	store := cauth.NewEmptyMemoryCredentialStore()
+	store.Store(ctx, "", "pushgateway", cauth.NewCredentialParamsFromTuples("access_token", "secret-token"))
+	references := cref.NewReferencesFromTuples(ctx,
+		cref.NewDescriptor("pip-services", "credential_store", "memory", "default", "1.0"), store,
+	)
+
+	for _, test := range []struct {
+		config   *cconf.ConfigParams
+		expected string
+	}{
+		{cconf.NewConfigParamsFromTuples("credential.username", "user", "credential.password", "pass"), "Basic dXNlcjpwYXNz"},
+		{cconf.NewConfigParamsFromTuples("credential.access_token", "token"), "Bearer token"},
+		{cconf.NewConfigParamsFromTuples("credential.store_key", "pushgateway"), "Bearer secret-token"},
+		{cconf.NewEmptyConfigParams(), ""},
+	} {
+		counters := pcount.NewPrometheusCounters()
+		counters.Configure(ctx, cconf.NewConfigParamsFromTuples("connection.uri", server.URL).Override(test.config))
+		counters.SetReferences(ctx, references)
+		err := counters.Open(ctx, "")
+		assert.Nil(t, err)
+
+		counters.Last(ctx, "test.value", 3)
+		err = counters.Save(ctx, counters.GetAllCountersStats())
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, <-headers)
+		counters.Close(ctx, "")
+	}
+
+	// Missing credential store fails to open the component
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"credential.store_key", "pushgateway",
+	))
+	err := counters.Open(ctx, "")
+	assert.NotNil(t, err)
+}
+
+func TestPrometheusCountersTls(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Client certificate is self-signed and trusted by the server
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	clientCert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	crtFile := writePemFile(t, dir, "client.crt", "CERTIFICATE", der)
+	keyFile := writePemFile(t, dir, "client.key", "EC PRIVATE KEY", keyDer)
+
+	pushes := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		pushes++
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	caFile := writePemFile(t, dir, "ca.crt", "CERTIFICATE", server.Certificate().Raw)
+
+	address, _ := url.Parse(server.URL)
+	hostConfig := cconf.NewConfigParamsFromTuples(
+		"connection.protocol", "https",
+		"connection.host", address.Hostname(),
+		"connection.port", address.Port(),
+		"credential.ssl_ca_file", caFile,
+		"credential.ssl_crt_file", crtFile,
+		"credential.ssl_key_file", keyFile,
+		"options.tls_server_name", "example.com",
+		"options.retries", 1,
+	)
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.uri", server.URL,
+		"credential.ssl_ca_file", caFile,
+		"credential.ssl_crt_file", crtFile,
+		"credential.ssl_key_file", keyFile,
+		"options.tls_server_name", "example.com",
+		"options.tls_min_version", "1.3",
+		"options.retries", 1,
+	)
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, config)
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pushes)
+	counters.Close(ctx, "")
+
+	// Connection set by protocol, host and port uses the same certificates
+	counters = pcount.NewPrometheusCounters()
+	counters.Configure(ctx, hostConfig)
+	err = counters.Open(ctx, "")
+	assert.Nil(t, err)
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pushes)
+	counters.Close(ctx, "")
+
+	// Certificate of the server is not valid for the name
+	counters = pcount.NewPrometheusCounters()
+	counters.Configure(ctx, config.Override(cconf.NewConfigParamsFromTuples("options.tls_server_name", "wrong.example")))
+	err = counters.Open(ctx, "")
+	assert.Nil(t, err)
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, pushes)
+	counters.Close(ctx, "")
+
+	for _, test := range []struct {
+		config   *cconf.ConfigParams
+		code     string
+		category string
+	}{
+		{cconf.NewConfigParamsFromTuples("credential.ssl_ca_file", filepath.Join(dir, "missing.crt")), "CANNOT_READ_CA_FILE", cerr.NoResponse},
+		{cconf.NewConfigParamsFromTuples("credential.ssl_ca_file", keyFile), "INVALID_CA_FILE", cerr.NoResponse},
+		{cconf.NewConfigParamsFromTuples("credential.ssl_key_file", crtFile), "INVALID_CLIENT_CERTIFICATE", cerr.NoResponse},
+		{cconf.NewConfigParamsFromTuples("credential.ssl_key_file", ""), "NO_CLIENT_CERTIFICATE", cerr.NoResponse},
+		{cconf.NewConfigParamsFromTuples("options.tls_min_version", "2.0"), "INVALID_TLS_VERSION", cerr.Misconfiguration},
+	} {
+		for _, connection := range []*cconf.ConfigParams{config, hostConfig} {
+			counters = pcount.NewPrometheusCounters()
+			counters.Configure(ctx, connection.Override(test.config))
+			err = counters.Open(ctx, "")
+			if assert.NotNil(t, err, test.code) {
+				assert.Equal(t, test.code, err.(*cerr.ApplicationError).Code)
+				assert.Equal(t, test.category, err.(*cerr.ApplicationError).Category)
+			}
+			assert.False(t, counters.IsOpen())
+		}
+	}
+
+	// Client certificates are not required when only CA or authentication is set
+	server = httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		pushes++
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	defer server.Close()
+	caFile = writePemFile(t, dir, "server.crt", "CERTIFICATE", server.Certificate().Raw)
+	address, _ = url.Parse(server.URL)
+	hostConfig = cconf.NewConfigParamsFromTuples(
+		"connection.protocol", "https",
+		"connection.host", address.Hostname(),
+		"connection.port", address.Port(),
+		"options.retries", 1,
+	)
+
+	counters = pcount.NewPrometheusCounters()
+	counters.Configure(ctx, hostConfig.Override(cconf.NewConfigParamsFromTuples("credential.ssl_ca_file", caFile)))
+	err = counters.Open(ctx, "")
+	assert.Nil(t, err)
+	counters.Last(ctx, "test.value", 3)
+	err = counters.Save(ctx, counters.GetAllCountersStats())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, pushes)
+	counters.Close(ctx, "")
+
+	for _, credential := range []*cconf.ConfigParams{
+		cconf.NewConfigParamsFromTuples("credential.access_token", "token"),
+		cconf.NewConfigParamsFromTuples("credential.username", "user", "credential.password", "pass"),
+	} {
+		counters = pcount.NewPrometheusCounters()
+		counters.Configure(ctx, hostConfig.Override(credential))
+		err = counters.Open(ctx, "")
+		assert.Nil(t, err)
+		assert.True(t, counters.IsOpen())
+		counters.Close(ctx, "")
+	}
+}
+
+func writePemFile(t *testing.T, dir string, name string, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	assert.Nil(t, err)
+	return path
+}
@@ -0,0 +1,156 @@
+package test_count
+
+import (
+	"testing"
+	"time"
+
+	cerr "github.com/pip-services3-gox/pip-services3-commons-gox/errors"
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+	pcount "github.com/pip-services3-gox/pip-services3-prometheus-gox/count"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusExpositionParserText(t *testing.T) {
+	exposition := "# HELP http_requests_total Total HTTP requests\\nserved\n" +
+		"# TYPE http_requests_total counter\n" +
+		`http_requests_total{method="get",code="200"} 1027 1395066363000` + "\n" +
+		`http_requests_total{method="post",code="400"} 3` + "\n" +
+		"\n" +
+		"# TYPE request_duration histogram\n" +
+		`request_duration_bucket{le="0.1"} 2` + "\n" +
+		`request_duration_bucket{le="+Inf"} 5` + "\n" +
+		"request_duration_sum 1.5\n" +
+		"request_duration_count 5\n" +
+		"# TYPE rpc_duration summary\n" +
+		`rpc_duration{quantile="0.5"} 4` + "\n" +
+		"rpc_duration_sum 20\n" +
+		"rpc_duration_count 4\n" +
+		`escaped{path="C:\\dir\\\"x\"\n"} NaN` + "\n"
+
+	families, err := pcount.ParsePrometheusExposition([]byte(exposition))
+	assert.Nil(t, err)
+	assert.Len(t, families, 4)
+
+	requests := families[0]
+	assert.Equal(t, "http_requests", requests.Name)
+	assert.Equal(t, pcount.PrometheusTypeCounter, requests.Type)
+	assert.Equal(t, "Total HTTP requests\nserved", requests.Help)
+	assert.Len(t, requests.Metrics, 2)
+	assert.Equal(t, []pcount.PrometheusLabel{{Name: "code", Value: "200"}, {Name: "method", Value: "get"}}, requests.Metrics[0].Labels)
+	assert.Equal(t, float64(1027), requests.Metrics[0].Value)
+
+	histogram := families[1]
+	assert.Equal(t, pcount.PrometheusTypeHistogram, histogram.Type)
+	assert.Len(t, histogram.Metrics, 1)
+	assert.Equal(t, []pcount.PrometheusBucket{{UpperBound: 0.1, CumulativeCount: 2}}, histogram.Metrics[0].Buckets)
+	assert.Equal(t, uint64(5), histogram.Metrics[0].Count)
+	assert.Equal(t, 1.5, histogram.Metrics[0].Sum)
+
+	summary := families[2]
+	assert.Equal(t, pcount.PrometheusTypeSummary, summary.Type)
+	assert.Equal(t, []pcount.PrometheusQuantile{{Quantile: 0.5, Value: 4}}, summary.Metrics[0].Quantiles)
+	assert.Equal(t, uint64(4), summary.Metrics[0].Count)
+
+	escaped := families[3]
+	assert.Equal(t, pcount.PrometheusTypeUntyped, escaped.Type)
+	assert.Equal(t, "C:\\dir\\\"x\"\n", escaped.Metrics[0].Labels[0].Value)
+}
+
+func TestPrometheusExpositionParserRoundTrip(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	exemplar := &pcount.PrometheusExemplar{
+		Labels:    []pcount.PrometheusLabel{{Name: "trace_id", Value: "abc"}},
+		Value:     1,
+		Timestamp: created,
+	}
+	families := []*pcount.PrometheusMetricFamily{
+		{Name: "calls", Type: pcount.PrometheusTypeCounter, Help: "Number of \"calls\"", Metrics: []*pcount.PrometheusMetric{
+			{Labels: []pcount.PrometheusLabel{{Name: "service", Value: "a"}}, Value: 3, Created: created, Exemplar: exemplar},
+		}},
+		{Name: "exec_time", Type: pcount.PrometheusTypeHistogram, Metrics: []*pcount.PrometheusMetric{
+			{Count: 3, Sum: 6, Created: created, Buckets: []pcount.PrometheusBucket{
+				{UpperBound: 1, CumulativeCount: 1},
+				{UpperBound: 2.5, CumulativeCount: 2, Exemplar: exemplar},
+			}},
+		}},
+		{Name: "memory_bytes", Type: pcount.PrometheusTypeGauge, Unit: "bytes", Metrics: []*pcount.PrometheusMetric{
+			{Value: 1024},
+		}},
+	}
+
+	converter := pcount.NewPrometheusCounterConverter()
+	for _, format := range []string{pcount.PrometheusTextFormat, pcount.PrometheusOpenMetricsFormat} {
+		parsed, err := pcount.ParsePrometheusExposition(converter.FormatFamilies(format, families))
+		assert.Nil(t, err)
+		assert.Len(t, parsed, 3)
+
+		assert.Equal(t, "calls", parsed[0].Name)
+		assert.Equal(t, families[0].Help, parsed[0].Help)
+		assert.Equal(t, families[0].Metrics[0].Labels, parsed[0].Metrics[0].Labels)
+		assert.Equal(t, float64(3), parsed[0].Metrics[0].Value)
+
+		assert.Equal(t, uint64(3), parsed[1].Metrics[0].Count)
+		assert.Equal(t, float64(6), parsed[1].Metrics[0].Sum)
+		assert.Len(t, parsed[1].Metrics[0].Buckets, 2)
+
+		assert.Equal(t, "memory_bytes", parsed[2].Name)
+		assert.Equal(t, float64(1024), parsed[2].Metrics[0].Value)
+
+		if format == pcount.PrometheusOpenMetricsFormat {
+			assert.True(t, created.Equal(parsed[0].Metrics[0].Created))
+			assert.NotNil(t, parsed[0].Metrics[0].Exemplar)
+			assert.Equal(t, "abc", parsed[0].Metrics[0].Exemplar.Labels[0].Value)
+			assert.True(t, created.Equal(parsed[0].Metrics[0].Exemplar.Timestamp))
+			assert.NotNil(t, parsed[1].Metrics[0].Buckets[1].Exemplar)
+			assert.Equal(t, "bytes", parsed[2].Unit)
+		}
+	}
+}
+
+func TestPrometheusExpositionParserErrors(t *testing.T) {
+	for _, exposition := range []string{
+		"# TYPE test foo\n",
+		"test\n",
+		"test abc\n",
+		"test 1 2 3\n",
+		`test{label="value} 1` + "\n",
+		`test{1label="value"} 1` + "\n",
+		"# TYPE test histogram\ntest 1\n",
+		"test 1\n# TYPE test gauge\n",
+	} {
+		_, err := pcount.ParsePrometheusExposition([]byte(exposition))
+		assert.NotNil(t, err, exposition)
+	}
+
+	_, err := pcount.ParsePrometheusExposition([]byte("test 1\ntest{ 1\n"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, err.(*cerr.ApplicationError).Details["line"])
+}
+
+func TestPrometheusFamiliesToCounters(t *testing.T) {
+	counters := []ccount.Counter{
+		{Name: "test.calls", Type: ccount.Increment, Count: 5},
+		{Name: "test.value", Type: ccount.LastValue, Last: 1.5},
+	}
+
+	converter := pcount.NewPrometheusCounterConverter()
+	families, err := pcount.ParsePrometheusExposition(converter.ToFormat(pcount.PrometheusTextFormat, counters, "app", ""))
+	assert.Nil(t, err)
+
+	parsed := pcount.PrometheusFamiliesToCounters(families)
+	assert.Len(t, parsed, 2)
+	assert.Equal(t, "test_calls.app", parsed[0].Name)
+	assert.Equal(t, ccount.LastValue, parsed[0].Type)
+	assert.Equal(t, float64(5), parsed[0].Last)
+	assert.Equal(t, "test_value.app", parsed[1].Name)
+	assert.Equal(t, 1.5, parsed[1].Last)
+
+	converter.SetNativeCounters(true)
+	families, err = pcount.ParsePrometheusExposition(converter.ToFormat(pcount.PrometheusTextFormat, counters, "", ""))
+	assert.Nil(t, err)
+
+	parsed = pcount.PrometheusFamiliesToCounters(families)
+	assert.Equal(t, "test_calls", parsed[0].Name)
+	assert.Equal(t, ccount.Increment, parsed[0].Type)
+	assert.Equal(t, int64(5), parsed[0].Count)
+}
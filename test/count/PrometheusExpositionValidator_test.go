@@ -0,0 +1,143 @@
+package test_count
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	pcount "github.com/pip-services3-gox/pip-services3-prometheus-gox/count"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusExpositionValidatorConverterOutput(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	exemplar := &pcount.PrometheusExemplar{
+		Labels:    []pcount.PrometheusLabel{{Name: "trace_id", Value: "abc"}},
+		Value:     1,
+		Timestamp: created,
+	}
+	families := []*pcount.PrometheusMetricFamily{
+		{Name: "calls", Type: pcount.PrometheusTypeCounter, Help: "Number of \"calls\"\n", Metrics: []*pcount.PrometheusMetric{
+			{Labels: []pcount.PrometheusLabel{{Name: "path", Value: "C:\\dir\"\n"}}, Value: 3, Created: created, Exemplar: exemplar},
+		}},
+		{Name: "exec_time", Type: pcount.PrometheusTypeHistogram, Metrics: []*pcount.PrometheusMetric{
+			{Count: 3, Sum: 6, Created: created, Buckets: []pcount.PrometheusBucket{
+				{UpperBound: 1, CumulativeCount: 1},
+				{UpperBound: 2.5, CumulativeCount: 2, Exemplar: exemplar},
+			}},
+		}},
+		{Name: "rpc_time", Type: pcount.PrometheusTypeSummary, Metrics: []*pcount.PrometheusMetric{
+			{Count: 2, Sum: 4, Quantiles: []pcount.PrometheusQuantile{{Quantile: 0.5, Value: 2}}},
+		}},
+		{Name: "memory_bytes", Type: pcount.PrometheusTypeGauge, Unit: "bytes", Metrics: []*pcount.PrometheusMetric{
+			{Value: math.NaN()},
+		}},
+		{Name: "other", Type: pcount.PrometheusTypeUntyped, Metrics: []*pcount.PrometheusMetric{
+			{Value: math.Inf(-1)},
+		}},
+	}
+
+	converter := pcount.NewPrometheusCounterConverter()
+	for _, format := range []string{pcount.PrometheusTextFormat, pcount.PrometheusOpenMetricsFormat} {
+		exposition := converter.FormatFamilies(format, families)
+		assert.Empty(t, pcount.Validate(exposition), format)
+		assert.Empty(t, pcount.ValidateFormat(format, exposition), format)
+
+		assert.Empty(t, pcount.Validate(converter.ToFormat(format, benchmarkPrometheusCounters(), "app", "instance")), format)
+	}
+
+	converter.SetNativeCounters(true)
+	for _, format := range []string{pcount.PrometheusTextFormat, pcount.PrometheusOpenMetricsFormat} {
+		assert.Empty(t, pcount.ValidateFormat(format, converter.ToFormat(format, benchmarkPrometheusCounters(), "", "")), format)
+	}
+}
+
+func TestPrometheusExpositionValidatorText(t *testing.T) {
+	exposition := "# HELP test_a Invalid \\escape\n" +
+		"# TYPE test_a gauge\n" +
+		"test_a 1\n" +
+		"# TYPE test_a gauge\n" +
+		"test_b{label=\"value\",label=\"x\"} 2\n" +
+		"test_a{x=\"1\"} 3\n" +
+		"test_b{__name=\"\\t\"} 4\n" +
+		"test_c 1 # {trace_id=\"abc\"} 1\n" +
+		"test_d 1 1.5\n" +
+		"# TYPE test_e histogram\n" +
+		"test_e_bucket{le=\"1\"} 1\n" +
+		"test_e_count 1\n" +
+		"test_e_bucket 1\n" +
+		"# TYPE test_f summary\n" +
+		"test_f 1\n" +
+		"test_c 2\n" +
+		"# TYPE test_g counter\n" +
+		"test_g -1"
+
+	errors := pcount.ValidateFormat(pcount.PrometheusTextFormat, []byte(exposition))
+	assertValidationErrors(t, errors, []pcount.ValidationError{
+		{Line: 0, Message: "last line is not terminated by a line feed"},
+		{Line: 1, Message: "invalid escape sequence \\e in HELP of test_a"},
+		{Line: 4, Message: "duplicate TYPE line of test_a"},
+		{Line: 5, Message: "duplicate label label"},
+		{Line: 6, Message: "lines of family test_a are interleaved with other families"},
+		{Line: 7, Message: "label name __name is reserved for internal use"},
+		{Line: 7, Message: "invalid escape sequence \\t in value of label __name"},
+		{Line: 8, Message: "exemplars are not supported in the text format"},
+		{Line: 9, Message: "invalid timestamp of test_d: \"1.5\""},
+		{Line: 13, Message: "bucket test_e_bucket without le label"},
+		{Line: 15, Message: "summary test_f without quantile label"},
+		{Line: 16, Message: "lines of family test_c are interleaved with other families"},
+		{Line: 16, Message: "duplicate sample test_c of series reported at line 8"},
+		{Line: 18, Message: "negative value of counter test_g"},
+		{Line: 11, Message: "histogram test_e without +Inf bucket"},
+	})
+}
+
+func TestPrometheusExpositionValidatorOpenMetrics(t *testing.T) {
+	exposition := "# TYPE test_a counter\n" +
+		"test_a 1\n" +
+		"test_a_total 1 # {trace_id=\"abc\"} x\n" +
+		"# HELP test_a Late help\n" +
+		"\n" +
+		"# a comment\n" +
+		"# TYPE test_b untyped\n" +
+		"# TYPE test_c_seconds gauge\n" +
+		"# UNIT test_c_seconds bytes\n" +
+		"test_c_seconds 1 # {trace_id=\"abc\"} 1\n"
+
+	errors := pcount.Validate([]byte(exposition))
+	assertValidationErrors(t, errors, []pcount.ValidationError{
+		{Line: 3, Message: "exemplars are not supported in the text format"},
+		{Line: 4, Message: "lines of family test_a are interleaved with other families"},
+		{Line: 10, Message: "exemplars are not supported in the text format"},
+	})
+
+	errors = pcount.ValidateFormat(pcount.PrometheusOpenMetricsFormat, []byte(exposition))
+	assertValidationErrors(t, errors, []pcount.ValidationError{
+		{Line: 2, Message: "sample test_a doesn't have a suffix of counter test_a"},
+		{Line: 3, Message: "invalid exemplar value of test_a_total: \"x\""},
+		{Line: 4, Message: "HELP line of test_a after its samples"},
+		{Line: 5, Message: "empty line"},
+		{Line: 6, Message: "unexpected comment, only HELP, TYPE, UNIT and EOF lines are allowed"},
+		{Line: 7, Message: "unsupported metric type \"untyped\""},
+		{Line: 9, Message: "name of test_c_seconds doesn't end with unit bytes"},
+		{Line: 10, Message: "exemplar of test_c_seconds which is not a counter or a histogram bucket"},
+		{Line: 0, Message: "missing # EOF line"},
+	})
+
+	errors = pcount.Validate([]byte("test_a 1\n# EOF\ntest_b 1\n"))
+	assertValidationErrors(t, errors, []pcount.ValidationError{
+		{Line: 3, Message: "line after # EOF"},
+	})
+}
+
+func assertValidationErrors(t *testing.T, actual []pcount.ValidationError, expected []pcount.ValidationError) {
+	if !assert.Len(t, actual, len(expected)) {
+		for _, err := range actual {
+			t.Log(err.Error())
+		}
+		return
+	}
+	for index := range expected {
+		assert.Equal(t, expected[index], actual[index])
+	}
+}
@@ -0,0 +1,122 @@
+package test_count
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
+	ccount "github.com/pip-services3-gox/pip-services3-components-gox/count"
+	pcount "github.com/pip-services3-gox/pip-services3-prometheus-gox/count"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusMappingRuleTemplate(t *testing.T) {
+	rule, err := pcount.NewPrometheusMappingRule("*.v2.*.calls", "calls_total", "service", "command")
+	assert.Nil(t, err)
+
+	name, labels, ok := rule.Match("orders.v2.create.calls")
+	assert.True(t, ok)
+	assert.Equal(t, "calls_total", name)
+	assert.Equal(t, []pcount.PrometheusLabel{
+		{Name: "service", Value: "orders"},
+		{Name: "command", Value: "create"},
+	}, labels)
+
+	_, _, ok = rule.Match("orders.v1.create.calls")
+	assert.False(t, ok)
+
+	rule, err = pcount.NewPrometheusMappingRule("db.*.**.errors", "", "table", "")
+	assert.Nil(t, err)
+
+	name, labels, ok = rule.Match("db.users.query.by_id.errors")
+	assert.True(t, ok)
+	assert.Equal(t, "db_errors", name)
+	assert.Equal(t, []pcount.PrometheusLabel{{Name: "table", Value: "users"}}, labels)
+}
+
+func TestPrometheusMappingRuleRegex(t *testing.T) {
+	rule, err := pcount.NewPrometheusRegexMappingRule(`^db\.(?P<table>\w+)\.(?P<operation>\w+)\.(\w+)$`, "db_${3}")
+	assert.Nil(t, err)
+
+	name, labels, ok := rule.Match("db.users.query.errors")
+	assert.True(t, ok)
+	assert.Equal(t, "db_errors", name)
+	assert.Equal(t, []pcount.PrometheusLabel{
+		{Name: "table", Value: "users"},
+		{Name: "operation", Value: "query"},
+	}, labels)
+
+	rule, err = pcount.NewPrometheusRegexMappingRule(`db\.(\w+)`, "db", "table")
+	assert.Nil(t, err)
+
+	name, labels, ok = rule.Match("db.users")
+	assert.True(t, ok)
+	assert.Equal(t, []pcount.PrometheusLabel{{Name: "table", Value: "users"}}, labels)
+
+	_, _, ok = rule.Match("db.users.query")
+	assert.False(t, ok)
+	_, _, ok = rule.Match("mydb.users")
+	assert.False(t, ok)
+
+	_, err = pcount.NewPrometheusRegexMappingRule(`(`, "")
+	assert.NotNil(t, err)
+}
+
+func TestPrometheusCounterConverterMappingRules(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"mapping.rules.0.pattern", "*.*.*.calls",
+		"mapping.rules.0.name", "calls_total",
+		"mapping.rules.0.labels", "service,version,command",
+		"mapping.rules.1.regex", `^db\.(\w+)\.(\w+)\.errors$`,
+		"mapping.rules.1.name", "db_errors",
+		"mapping.rules.1.labels", "table, operation",
+	))
+
+	counters := []ccount.Counter{
+		{Name: "orders.v2.create.calls", Type: ccount.LastValue, Last: 1},
+		{Name: "db.users.query.errors", Type: ccount.LastValue, Last: 2},
+		{Name: "svc.cmd.exec_time", Type: ccount.Interval, Count: 3},
+	}
+
+	body := converter.ToString(counters, "", "")
+	assert.True(t, strings.Contains(body, `calls_total{command="create",service="orders",version="v2"} 1`))
+	assert.True(t, strings.Contains(body, `db_errors{operation="query",table="users"} 2`))
+	assert.True(t, strings.Contains(body, `exec_time_count{command="cmd",service="svc"} 3`))
+}
+
+func TestPrometheusCounterConverterReconfigure(t *testing.T) {
+	converter := pcount.NewPrometheusCounterConverter()
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"mapping.rules.0.pattern", "*.calls",
+		"mapping.rules.0.name", "calls_total",
+		"mapping.rules.0.labels", "service",
+		"labels.env", "prod",
+	))
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"mapping.rules.0.pattern", "*.errors",
+		"mapping.rules.0.name", "errors_total",
+		"mapping.rules.0.labels", "service",
+		"labels.region", "eu",
+	))
+
+	assert.Len(t, converter.MappingRules(), 1+len(pcount.DefaultPrometheusMappingRules))
+	assert.Equal(t, []pcount.PrometheusLabel{{Name: "region", Value: "eu"}}, converter.ConstLabels())
+
+	counters := []ccount.Counter{
+		{Name: "orders.calls", Type: ccount.LastValue, Last: 1},
+		{Name: "orders.errors", Type: ccount.LastValue, Last: 2},
+	}
+
+	body := converter.ToString(counters, "", "")
+	assert.True(t, strings.Contains(body, `orders_calls{region="eu"} 1`))
+	assert.True(t, strings.Contains(body, `errors_total{region="eu",service="orders"} 2`))
+
+	// Configuration without rules and labels keeps the current ones
+	converter.Configure(context.Background(), cconf.NewConfigParamsFromTuples(
+		"options.namespace", "acme",
+	))
+	assert.Len(t, converter.MappingRules(), 1+len(pcount.DefaultPrometheusMappingRules))
+	assert.Len(t, converter.ConstLabels(), 1)
+}
@@ -0,0 +1,41 @@
+package test_count
+
+import (
+	"testing"
+
+	pcount "github.com/pip-services3-gox/pip-services3-prometheus-gox/count"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	sanitizer := pcount.PrometheusNameSanitizer
+
+	assert.Equal(t, "", sanitizer.SanitizeMetricName(""))
+	assert.Equal(t, "my_metric:total", sanitizer.SanitizeMetricName("my_metric:total"))
+	assert.Equal(t, "my_service_calls", sanitizer.SanitizeMetricName("my-service calls"))
+	assert.Equal(t, "_1st_value", sanitizer.SanitizeMetricName("1st.value"))
+	assert.Equal(t, "caf_", sanitizer.SanitizeMetricName("café"))
+
+	assert.True(t, sanitizer.IsValidMetricName("a:b_c1"))
+	assert.False(t, sanitizer.IsValidMetricName("1abc"))
+	assert.False(t, sanitizer.IsValidMetricName(""))
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	sanitizer := pcount.PrometheusNameSanitizer
+
+	assert.Equal(t, "a_b", sanitizer.SanitizeLabelName("a:b"))
+	assert.Equal(t, "_name", sanitizer.SanitizeLabelName("__name"))
+	assert.Equal(t, "_2xx", sanitizer.SanitizeLabelName("2xx"))
+
+	assert.True(t, sanitizer.IsValidLabelName("status_code"))
+	assert.False(t, sanitizer.IsValidLabelName("status:code"))
+}
+
+func TestEscapeLabelValueAndHelp(t *testing.T) {
+	sanitizer := pcount.PrometheusNameSanitizer
+
+	assert.Equal(t, `a\\b\"c\nd`, sanitizer.EscapeLabelValue("a\\b\"c\nd"))
+	assert.Equal(t, `a\\b"c\nd`, sanitizer.EscapeHelp("a\\b\"c\nd"))
+	assert.Equal(t, `a\\b\"c\nd`, sanitizer.EscapeOpenMetricsHelp("a\\b\"c\nd"))
+}
@@ -2,9 +2,12 @@ package test_services
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	cconf "github.com/pip-services3-gox/pip-services3-commons-gox/config"
 	cref "github.com/pip-services3-gox/pip-services3-commons-gox/refer"
@@ -52,15 +55,142 @@ func TestPrometheusMetricsService(t *testing.T) {
 
 	var url = "http://localhost:3000"
 
+	counters.Metadata().Register("test.counter3", pcount.PrometheusMetadata{Help: "Last value"})
 	counters.IncrementOne(ctx, "test.counter1")
 	counters.Stats(ctx, "test.counter2", 2)
 	counters.Last(ctx, "test.counter3", 3)
 	counters.TimestampNow(ctx, "test.counter4")
 
-	getRes, getErr := http.Get(url + "/metrics")
+	// The endpoint starts listening asynchronously
+	var getRes *http.Response
+	var getErr error
+	for retries := 0; retries < 20; retries++ {
+		getRes, getErr = http.Get(url + "/metrics")
+		if getErr == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 	assert.Nil(t, getErr)
 	assert.NotNil(t, getRes)
 	assert.True(t, getRes.StatusCode < 400)
+	assert.Equal(t, pcount.PrometheusTextContentType, getRes.Header.Get("Content-Type"))
 	body, _ := ioutil.ReadAll(getRes.Body)
-	assert.True(t, len(body) > 0)
+	getRes.Body.Close()
+	families, parseErr := pcount.ParsePrometheusExposition(body)
+	assert.Nil(t, parseErr)
+	values := map[string]float64{}
+	help := map[string]string{}
+	for _, family := range families {
+		assert.Len(t, family.Metrics, 1)
+		values[family.Name] = family.Metrics[0].Value
+		help[family.Name] = family.Help
+	}
+	assert.Equal(t, "Last value", help["test_counter3"])
+	assert.Equal(t, float64(1), values["test_counter1"])
+	assert.Equal(t, float64(2), values["test_counter2_max"])
+	assert.Equal(t, float64(3), values["test_counter3"])
+	assert.Contains(t, values, "test_counter4")
+
+	req, _ := http.NewRequest(http.MethodGet, url+"/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	getRes, getErr = http.DefaultClient.Do(req)
+	assert.Nil(t, getErr)
+	assert.Equal(t, pcount.PrometheusOpenMetricsContentType, getRes.Header.Get("Content-Type"))
+	body, _ = ioutil.ReadAll(getRes.Body)
+	getRes.Body.Close()
+	assert.True(t, strings.HasSuffix(string(body), "# EOF\n"))
+	families, parseErr = pcount.ParsePrometheusExposition(body)
+	assert.Nil(t, parseErr)
+	assert.Len(t, families, 7)
+
+	for _, jsonReq := range []*http.Request{
+		newMetricsRequest(url+"/metrics?format=json", ""),
+		newMetricsRequest(url+"/metrics", "application/json, text/plain;q=0.5"),
+	} {
+		getRes, getErr = http.DefaultClient.Do(jsonReq)
+		assert.Nil(t, getErr)
+		assert.Equal(t, "application/json", getRes.Header.Get("Content-Type"))
+		var counters []map[string]any
+		jsonErr := json.NewDecoder(getRes.Body).Decode(&counters)
+		getRes.Body.Close()
+		assert.Nil(t, jsonErr)
+		assert.Len(t, counters, 4)
+		assert.Equal(t, "test.counter1", counters[0]["name"])
+		assert.Equal(t, "increment", counters[0]["type"])
+		assert.Equal(t, float64(1), counters[0]["count"])
+		assert.Equal(t, []any{}, counters[0]["labels"])
+		assert.Equal(t, float64(2), counters[1]["max"])
+		assert.Equal(t, float64(3), counters[2]["last"])
+		assert.NotEmpty(t, counters[3]["time"])
+	}
+
+	// Other formats are requested by their names too
+	getRes, getErr = http.DefaultClient.Do(newMetricsRequest(url+"/metrics?format=openmetrics", ""))
+	assert.Nil(t, getErr)
+	assert.Equal(t, pcount.PrometheusOpenMetricsContentType, getRes.Header.Get("Content-Type"))
+	getRes.Body.Close()
+}
+
+func TestPrometheusMetricsServiceConverterSettings(t *testing.T) {
+	ctx := context.Background()
+
+	counters := pcount.NewPrometheusCounters()
+	counters.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"labels.env", "prod",
+		"options.namespace", "acme",
+		"options.subsystem", "orders",
+		"options.native_counters", true,
+		"mapping.rules.0.pattern", "*.calls",
+		"mapping.rules.0.name", "calls",
+		"mapping.rules.0.labels", "service",
+	))
+
+	// Settings configured in the service take precedence
+	service := pservice.NewPrometheusMetricsService()
+	service.Configure(ctx, cconf.NewConfigParamsFromTuples(
+		"connection.protocol", "http",
+		"connection.host", "localhost",
+		"connection.port", "3001",
+		"options.subsystem", "billing",
+	))
+
+	references := cref.NewReferencesFromTuples(ctx,
+		cref.NewDescriptor("pip-services", "counters", "prometheus", "default", "1.0"), counters,
+		cref.NewDescriptor("pip-services", "metrics-service", "prometheus", "default", "1.0"), service,
+	)
+	counters.SetReferences(ctx, references)
+	service.SetReferences(ctx, references)
+
+	err := counters.Open(ctx, "")
+	assert.Nil(t, err)
+	defer counters.Close(ctx, "")
+	err = service.Open(ctx, "")
+	assert.Nil(t, err)
+	defer service.Close(ctx, "")
+
+	counters.IncrementOne(ctx, "orders.calls")
+
+	var getRes *http.Response
+	var getErr error
+	for retries := 0; retries < 20; retries++ {
+		getRes, getErr = http.Get("http://localhost:3001/metrics")
+		if getErr == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Nil(t, getErr)
+	body, _ := ioutil.ReadAll(getRes.Body)
+	getRes.Body.Close()
+	assert.Equal(t, "# TYPE acme_billing_calls_total counter\n"+
+		"acme_billing_calls_total{env=\"prod\",service=\"orders\"} 1\n", string(body))
+}
+
+func newMetricsRequest(url string, accept string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return req
 }